@@ -3,6 +3,7 @@ module github.com/wiltonsr/ldapAuth
 go 1.17
 
 require (
+	github.com/go-asn1-ber/asn1-ber v1.5.4
 	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
@@ -10,6 +11,5 @@ require (
 
 require (
 	github.com/Azure/go-ntlmssp v0.0.0-20220621081337-cb9428e4ac1e // indirect
-	github.com/go-asn1-ber/asn1-ber v1.5.4 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
 )
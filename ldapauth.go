@@ -3,23 +3,49 @@
 package ldapAuth
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/go-ldap/ldap/v3"
 	"github.com/gorilla/sessions"
@@ -28,7 +54,6 @@ import (
 
 // nolint
 var (
-	store *sessions.CookieStore
 	// LoggerDEBUG level.
 	LoggerDEBUG = log.New(ioutil.Discard, "DEBUG: ldapAuth: ", log.Ldate|log.Ltime|log.Lshortfile)
 	// LoggerINFO level.
@@ -37,6 +62,12 @@ var (
 	LoggerWARNING = log.New(ioutil.Discard, "WARNING: ldapAuth: ", log.Ldate|log.Ltime|log.Lshortfile)
 	// LoggerERROR level.
 	LoggerERROR = log.New(ioutil.Discard, "ERROR: ldapAuth: ", log.Ldate|log.Ltime|log.Lshortfile)
+	// ErrServersDown is returned when no server in ServerList could be reached.
+	ErrServersDown = errors.New("All servers in ServerList are down")
+	// ErrEmptySearchResult is returned when the search filter does not match any entry.
+	ErrEmptySearchResult = errors.New("search filter return empty result")
+	// ErrSessionRevoked is returned when a cached session fails its revalidation.
+	ErrSessionRevoked = errors.New("session revoked")
 )
 
 type LdapServerConfig struct {
@@ -50,31 +81,147 @@ type LdapServerConfig struct {
 	CertificateAuthority string `json:"certificateAuthority,omitempty" yaml:"certificateAuthority,omitempty"`
 }
 
+// LdapRealmConfig a directory with its own servers, search and authorization settings.
+type LdapRealmConfig struct {
+	Name                    string             `json:"name,omitempty" yaml:"name,omitempty"`
+	Domains                 []string           `json:"domains,omitempty" yaml:"domains,omitempty"`
+	ServerList              []LdapServerConfig `json:"serverList,omitempty" yaml:"serverList,omitempty"`
+	Attribute               string             `json:"attribute,omitempty" yaml:"attribute,omitempty"`
+	SearchFilter            string             `json:"searchFilter,omitempty" yaml:"searchFilter,omitempty"`
+	BaseDN                  string             `json:"baseDn,omitempty" yaml:"baseDn,omitempty"`
+	BindDN                  string             `json:"bindDn,omitempty" yaml:"bindDn,omitempty"`
+	BindPassword            string             `json:"bindPassword,omitempty" yaml:"bindPassword,omitempty"`
+	EnableNestedGroupFilter bool               `json:"enableNestedGroupsFilter,omitempty" yaml:"enableNestedGroupsFilter,omitempty"`
+	AllowedGroups           []string           `json:"allowedGroups,omitempty" yaml:"allowedGroups,omitempty"`
+	AllowedUsers            []string           `json:"allowedUsers,omitempty" yaml:"allowedUsers,omitempty"`
+	Requirements            RequirementsConfig `json:"requirements,omitempty" yaml:"requirements,omitempty"`
+	GroupMembership         string             `json:"groupMembership,omitempty" yaml:"groupMembership,omitempty"`
+	MemberOfAttribute       string             `json:"memberOfAttribute,omitempty" yaml:"memberOfAttribute,omitempty"`
+	NestedGroupResolution   bool               `json:"nestedGroupResolution,omitempty" yaml:"nestedGroupResolution,omitempty"`
+	GroupBaseDN             string             `json:"groupBaseDn,omitempty" yaml:"groupBaseDn,omitempty"`
+}
+
+// RequirementsConfig boolean group and user requirements, in addition to AllowedGroups and
+// AllowedUsers. Deny requirements take precedence over any allow.
+type RequirementsConfig struct {
+	AllOfGroups []string `json:"allOfGroups,omitempty" yaml:"allOfGroups,omitempty"`
+	AnyOfGroups []string `json:"anyOfGroups,omitempty" yaml:"anyOfGroups,omitempty"`
+	DenyGroups  []string `json:"denyGroups,omitempty" yaml:"denyGroups,omitempty"`
+	DenyUsers   []string `json:"denyUsers,omitempty" yaml:"denyUsers,omitempty"`
+}
+
+// AuthorizationRule the authorization requirements of requests matching hosts, path and methods.
+type AuthorizationRule struct {
+	Name          string             `json:"name,omitempty" yaml:"name,omitempty"`
+	Hosts         []string           `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	PathPrefix    string             `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+	PathRegex     string             `json:"pathRegex,omitempty" yaml:"pathRegex,omitempty"`
+	Methods       []string           `json:"methods,omitempty" yaml:"methods,omitempty"`
+	AllowedUsers  []string           `json:"allowedUsers,omitempty" yaml:"allowedUsers,omitempty"`
+	AllowedGroups []string           `json:"allowedGroups,omitempty" yaml:"allowedGroups,omitempty"`
+	Requirements  RequirementsConfig `json:"requirements,omitempty" yaml:"requirements,omitempty"`
+	AllowAnyUser  bool               `json:"allowAnyUser,omitempty" yaml:"allowAnyUser,omitempty"`
+	pathRegexp    *regexp.Regexp
+}
+
+// AttributeHeader forward the values of an attribute of the user entry as a request header.
+type AttributeHeader struct {
+	Attribute string `json:"attribute,omitempty" yaml:"attribute,omitempty"`
+	Header    string `json:"header,omitempty" yaml:"header,omitempty"`
+	Separator string `json:"separator,omitempty" yaml:"separator,omitempty"`
+	Encoding  string `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	MaxLength int    `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+}
+
 // Config the plugin configuration.
 type Config struct {
-	Enabled                    bool               `json:"enabled,omitempty" yaml:"enabled,omitempty"`
-	LogLevel                   string             `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
-	ServerList                 []LdapServerConfig `json:"serverList,omitempty" yaml:"serverList,omitempty"`
-	CacheTimeout               uint32             `json:"cacheTimeout,omitempty" yaml:"cacheTimeout,omitempty"`
-	CacheCookieName            string             `json:"cacheCookieName,omitempty" yaml:"cacheCookieName,omitempty"`
-	CacheCookiePath            string             `json:"cacheCookiePath,omitempty" yaml:"cacheCookiePath,omitempty"`
-	CacheCookieSecure          bool               `json:"cacheCookieSecure,omitempty" yaml:"cacheCookieSecure,omitempty"`
-	CacheKey                   string             `json:"cacheKey,omitempty" yaml:"cacheKey,omitempty"`
-	Attribute                  string             `json:"attribute,omitempty" yaml:"attribute,omitempty"`
-	SearchFilter               string             `json:"searchFilter,omitempty" yaml:"searchFilter,omitempty"`
-	BaseDN                     string             `json:"baseDn,omitempty" yaml:"baseDn,omitempty"`
-	BindDN                     string             `json:"bindDn,omitempty" yaml:"bindDn,omitempty"`
-	BindPassword               string             `json:"bindPassword,omitempty" yaml:"bindPassword,omitempty"`
-	ForwardUsername            bool               `json:"forwardUsername,omitempty" yaml:"forwardUsername,omitempty"`
-	ForwardUsernameHeader      string             `json:"forwardUsernameHeader,omitempty" yaml:"forwardUsernameHeader,omitempty"`
-	ForwardAuthorization       bool               `json:"forwardAuthorization,omitempty" yaml:"forwardAuthorization,omitempty"`
-	ForwardExtraLdapHeaders    bool               `json:"forwardExtraLdapHeaders,omitempty" yaml:"forwardExtraLdapHeaders,omitempty"`
-	WWWAuthenticateHeader      bool               `json:"wwwAuthenticateHeader,omitempty" yaml:"wwwAuthenticateHeader,omitempty"`
-	WWWAuthenticateHeaderRealm string             `json:"wwwAuthenticateHeaderRealm,omitempty" yaml:"wwwAuthenticateHeaderRealm,omitempty"`
-	EnableNestedGroupFilter    bool               `json:"enableNestedGroupsFilter,omitempty" yaml:"enableNestedGroupsFilter,omitempty"`
-	AllowedGroups              []string           `json:"allowedGroups,omitempty" yaml:"allowedGroups,omitempty"`
-	AllowedUsers               []string           `json:"allowedUsers,omitempty" yaml:"allowedUsers,omitempty"`
-	Username                   string
+	Enabled                    bool                `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	LogLevel                   string              `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+	LogFormat                  string              `json:"logFormat,omitempty" yaml:"logFormat,omitempty"`
+	LogRequestIDHeader         string              `json:"logRequestIdHeader,omitempty" yaml:"logRequestIdHeader,omitempty"`
+	MetricsPath                string              `json:"metricsPath,omitempty" yaml:"metricsPath,omitempty"`
+	MetricsPublic              bool                `json:"metricsPublic,omitempty" yaml:"metricsPublic,omitempty"`
+	AuditLogFile               string              `json:"auditLogFile,omitempty" yaml:"auditLogFile,omitempty"`
+	AuditSyslogAddress         string              `json:"auditSyslogAddress,omitempty" yaml:"auditSyslogAddress,omitempty"`
+	AuditBufferSize            uint32              `json:"auditBufferSize,omitempty" yaml:"auditBufferSize,omitempty"`
+	ServerList                 []LdapServerConfig  `json:"serverList,omitempty" yaml:"serverList,omitempty"`
+	CacheTimeout               uint32              `json:"cacheTimeout,omitempty" yaml:"cacheTimeout,omitempty"`
+	CacheCookieName            string              `json:"cacheCookieName,omitempty" yaml:"cacheCookieName,omitempty"`
+	CacheCookiePath            string              `json:"cacheCookiePath,omitempty" yaml:"cacheCookiePath,omitempty"`
+	CacheCookieSecure          bool                `json:"cacheCookieSecure,omitempty" yaml:"cacheCookieSecure,omitempty"`
+	CacheKey                   string              `json:"cacheKey,omitempty" yaml:"cacheKey,omitempty"`
+	CacheRevalidateInterval    uint32              `json:"cacheRevalidateInterval,omitempty" yaml:"cacheRevalidateInterval,omitempty"`
+	CacheIdleTimeout           uint32              `json:"cacheIdleTimeout,omitempty" yaml:"cacheIdleTimeout,omitempty"`
+	CacheMaxLifetime           uint32              `json:"cacheMaxLifetime,omitempty" yaml:"cacheMaxLifetime,omitempty"`
+	CredentialCacheTTL         uint32              `json:"credentialCacheTtl,omitempty" yaml:"credentialCacheTtl,omitempty"`
+	CredentialCacheSize        uint32              `json:"credentialCacheSize,omitempty" yaml:"credentialCacheSize,omitempty"`
+	NegativeCacheTTL           uint32              `json:"negativeCacheTtl,omitempty" yaml:"negativeCacheTtl,omitempty"`
+	NegativeCacheSize          uint32              `json:"negativeCacheSize,omitempty" yaml:"negativeCacheSize,omitempty"`
+	Attribute                  string              `json:"attribute,omitempty" yaml:"attribute,omitempty"`
+	SearchFilter               string              `json:"searchFilter,omitempty" yaml:"searchFilter,omitempty"`
+	BaseDN                     string              `json:"baseDn,omitempty" yaml:"baseDn,omitempty"`
+	BindDN                     string              `json:"bindDn,omitempty" yaml:"bindDn,omitempty"`
+	BindPassword               string              `json:"bindPassword,omitempty" yaml:"bindPassword,omitempty"`
+	ForwardUsername            bool                `json:"forwardUsername,omitempty" yaml:"forwardUsername,omitempty"`
+	ForwardUsernameHeader      string              `json:"forwardUsernameHeader,omitempty" yaml:"forwardUsernameHeader,omitempty"`
+	ForwardAuthorization       bool                `json:"forwardAuthorization,omitempty" yaml:"forwardAuthorization,omitempty"`
+	ForwardExtraLdapHeaders    bool                `json:"forwardExtraLdapHeaders,omitempty" yaml:"forwardExtraLdapHeaders,omitempty"`
+	WWWAuthenticateHeader      bool                `json:"wwwAuthenticateHeader,omitempty" yaml:"wwwAuthenticateHeader,omitempty"`
+	WWWAuthenticateHeaderRealm string              `json:"wwwAuthenticateHeaderRealm,omitempty" yaml:"wwwAuthenticateHeaderRealm,omitempty"`
+	EnableNestedGroupFilter    bool                `json:"enableNestedGroupsFilter,omitempty" yaml:"enableNestedGroupsFilter,omitempty"`
+	AllowedGroups              []string            `json:"allowedGroups,omitempty" yaml:"allowedGroups,omitempty"`
+	AllowedUsers               []string            `json:"allowedUsers,omitempty" yaml:"allowedUsers,omitempty"`
+	Requirements               RequirementsConfig  `json:"requirements,omitempty" yaml:"requirements,omitempty"`
+	GroupMembership            string              `json:"groupMembership,omitempty" yaml:"groupMembership,omitempty"`
+	MemberOfAttribute          string              `json:"memberOfAttribute,omitempty" yaml:"memberOfAttribute,omitempty"`
+	NestedGroupResolution      bool                `json:"nestedGroupResolution,omitempty" yaml:"nestedGroupResolution,omitempty"`
+	NestedGroupMaxDepth        uint                `json:"nestedGroupMaxDepth,omitempty" yaml:"nestedGroupMaxDepth,omitempty"`
+	GroupBaseDN                string              `json:"groupBaseDn,omitempty" yaml:"groupBaseDn,omitempty"`
+	PrimaryGroupResolution     bool                `json:"primaryGroupResolution,omitempty" yaml:"primaryGroupResolution,omitempty"`
+	GroupNameAttribute         string              `json:"groupNameAttribute,omitempty" yaml:"groupNameAttribute,omitempty"`
+	GroupRefreshInterval       uint32              `json:"groupRefreshInterval,omitempty" yaml:"groupRefreshInterval,omitempty"`
+	Realms                     []LdapRealmConfig   `json:"realms,omitempty" yaml:"realms,omitempty"`
+	ForwardRealmHeader         string              `json:"forwardRealmHeader,omitempty" yaml:"forwardRealmHeader,omitempty"`
+	LocalUsersFile             string              `json:"localUsersFile,omitempty" yaml:"localUsersFile,omitempty"`
+	LocalUsersMode             string              `json:"localUsersMode,omitempty" yaml:"localUsersMode,omitempty"`
+	ApiKeyAttribute            string              `json:"apiKeyAttribute,omitempty" yaml:"apiKeyAttribute,omitempty"`
+	ApiKeyHeader               string              `json:"apiKeyHeader,omitempty" yaml:"apiKeyHeader,omitempty"`
+	ApiKeyHashFormat           string              `json:"apiKeyHashFormat,omitempty" yaml:"apiKeyHashFormat,omitempty"`
+	ApiKeySearchFilter         string              `json:"apiKeySearchFilter,omitempty" yaml:"apiKeySearchFilter,omitempty"`
+	ClientCertAuth             bool                `json:"clientCertAuth,omitempty" yaml:"clientCertAuth,omitempty"`
+	ClientCertHeader           string              `json:"clientCertHeader,omitempty" yaml:"clientCertHeader,omitempty"`
+	ClientCertTrustHeader      bool                `json:"clientCertTrustHeader,omitempty" yaml:"clientCertTrustHeader,omitempty"`
+	ClientCertCA               string              `json:"clientCertCa,omitempty" yaml:"clientCertCa,omitempty"`
+	ClientCertSearchFilter     string              `json:"clientCertSearchFilter,omitempty" yaml:"clientCertSearchFilter,omitempty"`
+	ClientCertMatchEntry       bool                `json:"clientCertMatchEntry,omitempty" yaml:"clientCertMatchEntry,omitempty"`
+	PasswordChangePath         string              `json:"passwordChangePath,omitempty" yaml:"passwordChangePath,omitempty"`
+	PasswordChangeMode         string              `json:"passwordChangeMode,omitempty" yaml:"passwordChangeMode,omitempty"`
+	PasswordPolicyControl      bool                `json:"passwordPolicyControl,omitempty" yaml:"passwordPolicyControl,omitempty"`
+	ADAccountCheck             bool                `json:"adAccountCheck,omitempty" yaml:"adAccountCheck,omitempty"`
+	Rules                      []AuthorizationRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+	ForwardAttributes          []AttributeHeader   `json:"forwardAttributes,omitempty" yaml:"forwardAttributes,omitempty"`
+	ForwardGroups              bool                `json:"forwardGroups,omitempty" yaml:"forwardGroups,omitempty"`
+	ForwardGroupsHeader        string              `json:"forwardGroupsHeader,omitempty" yaml:"forwardGroupsHeader,omitempty"`
+	ForwardGroupsFilter        string              `json:"forwardGroupsFilter,omitempty" yaml:"forwardGroupsFilter,omitempty"`
+	ForwardGroupsCN            bool                `json:"forwardGroupsCn,omitempty" yaml:"forwardGroupsCn,omitempty"`
+	ForwardGroupsFormat        string              `json:"forwardGroupsFormat,omitempty" yaml:"forwardGroupsFormat,omitempty"`
+	ForwardGroupsSeparator     string              `json:"forwardGroupsSeparator,omitempty" yaml:"forwardGroupsSeparator,omitempty"`
+	ForwardJwt                 bool                `json:"forwardJwt,omitempty" yaml:"forwardJwt,omitempty"`
+	JwtHeader                  string              `json:"jwtHeader,omitempty" yaml:"jwtHeader,omitempty"`
+	JwtAlgorithm               string              `json:"jwtAlgorithm,omitempty" yaml:"jwtAlgorithm,omitempty"`
+	JwtKey                     string              `json:"jwtKey,omitempty" yaml:"jwtKey,omitempty"`
+	JwtKeyFile                 string              `json:"jwtKeyFile,omitempty" yaml:"jwtKeyFile,omitempty"`
+	JwtKeyID                   string              `json:"jwtKeyId,omitempty" yaml:"jwtKeyId,omitempty"`
+	JwtIssuer                  string              `json:"jwtIssuer,omitempty" yaml:"jwtIssuer,omitempty"`
+	JwtAudience                string              `json:"jwtAudience,omitempty" yaml:"jwtAudience,omitempty"`
+	JwtExpiration              uint32              `json:"jwtExpiration,omitempty" yaml:"jwtExpiration,omitempty"`
+	JwtAttributes              []string            `json:"jwtAttributes,omitempty" yaml:"jwtAttributes,omitempty"`
+	Realm                      string
+	groupResolver              *groupResolver
+	forwardGroupsRegexp        *regexp.Regexp
+	clientCertPool             *x509.CertPool
+	logger                     *Logger
+	metrics                    *instanceMetrics
 	// params below are deprecated use 'ServerList' instead
 	URL                  string `json:"url,omitempty" yaml:"url,omitempty"`
 	Port                 uint16 `json:"port,omitempty" yaml:"port,omitempty"`
@@ -90,12 +237,26 @@ func CreateConfig() *Config {
 	return &Config{
 		Enabled:                    true,
 		LogLevel:                   "INFO",
+		LogFormat:                  "text", // text or json
+		LogRequestIDHeader:         "X-Request-Id",
+		MetricsPath:                "",
+		MetricsPublic:              false,
+		AuditLogFile:               "",
+		AuditSyslogAddress:         "",
+		AuditBufferSize:            1024,
 		ServerList:                 []LdapServerConfig{},
 		CacheTimeout:               300, // In seconds, default to 5m
 		CacheCookieName:            "ldapAuth_session_token",
 		CacheCookiePath:            "",
 		CacheCookieSecure:          false,
 		CacheKey:                   "",
+		CacheRevalidateInterval:    0,     // In seconds, disabled by default
+		CacheIdleTimeout:           0,     // In seconds, disabled by default
+		CacheMaxLifetime:           28800, // In seconds, default to 8h
+		CredentialCacheTTL:         0,     // In seconds, disabled by default
+		CredentialCacheSize:        1000,
+		NegativeCacheTTL:           0, // In seconds, disabled by default
+		NegativeCacheSize:          10000,
 		Attribute:                  "cn", // Usually uid or sAMAccountname
 		SearchFilter:               "",
 		BaseDN:                     "",
@@ -110,7 +271,52 @@ func CreateConfig() *Config {
 		EnableNestedGroupFilter:    false,
 		AllowedGroups:              nil,
 		AllowedUsers:               nil,
-		Username:                   "",
+		Requirements:               RequirementsConfig{},
+		GroupMembership:            "search", // search or memberOf
+		MemberOfAttribute:          "memberOf",
+		NestedGroupResolution:      false,
+		NestedGroupMaxDepth:        10,
+		GroupBaseDN:                "", // Defaults to BaseDN
+		PrimaryGroupResolution:     false,
+		GroupNameAttribute:         "cn",
+		GroupRefreshInterval:       300, // In seconds, default to 5m
+		Realms:                     nil,
+		ForwardRealmHeader:         "Ldap-Realm",
+		LocalUsersFile:             "",
+		LocalUsersMode:             "unreachable", // unreachable or fallback
+		ApiKeyAttribute:            "",
+		ApiKeyHeader:               "X-API-Key",
+		ApiKeyHashFormat:           "hex", // hex or ldap
+		ApiKeySearchFilter:         "({{.ApiKeyAttribute}}={{.ApiKeyHash}})",
+		ClientCertAuth:             false,
+		ClientCertHeader:           "X-Forwarded-Tls-Client-Cert",
+		ClientCertTrustHeader:      false,
+		ClientCertCA:               "",
+		ClientCertSearchFilter:     "(mail={{.CertEmail}})",
+		ClientCertMatchEntry:       false,
+		PasswordChangePath:         "",
+		PasswordChangeMode:         "passwordModify", // passwordModify or activeDirectory
+		PasswordPolicyControl:      false,
+		ADAccountCheck:             false,
+		Rules:                      nil,
+		ForwardAttributes:          nil,
+		ForwardGroups:              false,
+		ForwardGroupsHeader:        "Ldap-Groups",
+		ForwardGroupsFilter:        "",
+		ForwardGroupsCN:            false,
+		ForwardGroupsFormat:        "delimited", // delimited or json
+		ForwardGroupsSeparator:     ",",
+		ForwardJwt:                 false,
+		JwtHeader:                  "Ldap-Jwt",
+		JwtAlgorithm:               "HS256", // HS256, HS384, HS512, RS256, RS384, RS512, ES256, ES384 or ES512
+		JwtKey:                     "",
+		JwtKeyFile:                 "",
+		JwtKeyID:                   "",
+		JwtIssuer:                  "",
+		JwtAudience:                "",
+		JwtExpiration:              60, // In seconds
+		JwtAttributes:              nil,
+		Realm:                      "",
 		// deprecated use 'ServerList' instead
 		URL: "",
 	}
@@ -118,20 +324,51 @@ func CreateConfig() *Config {
 
 // LdapAuth Struct plugin.
 type LdapAuth struct {
-	next   http.Handler
-	name   string
-	config *Config
+	next       http.Handler
+	name       string
+	config     *Config
+	logger     *Logger
+	realms     []*Config
+	localUsers map[string]LocalUser
+	jwtKey     interface{}
+	store      *sessions.CookieStore
+	// credentialCache remember authenticated credentials, and negativeCache failed ones, by their
+	// CredentialKey under hashKey.
+	credentialCache *TTLCache
+	negativeCache   *TTLCache
+	hashKey         []byte
+	audit           *AuditLogger
 }
 
 // New created a new LdapAuth plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	SetLogger(config.LogLevel)
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid logFormat '%s'", config.LogFormat)
+	}
+	// Unknown levels fall back to INFO, so configurations that used to start still do.
+	logLevel := config.LogLevel
+	if _, ok := parseLogLevel(logLevel); !ok {
+		config.LogLevel = "INFO"
+	}
+	// Realms and rules copy config, so they share this logger.
+	config.logger = NewLogger(name, config.LogLevel, config.LogFormat)
+	if logLevel != config.LogLevel {
+		config.logger.Warningf("Invalid logLevel '%s', using 'INFO' instead", logLevel)
+	}
 
-	LoggerINFO.Printf("Starting %s Middleware...", name)
+	collector := injectedCollector
+	if collector == nil && config.MetricsPath != "" {
+		collector = NewMetrics()
+	}
+	if collector != nil {
+		config.metrics = &instanceMetrics{collector: collector, instance: name}
+	}
+
+	config.logger.Infof("Starting %s Middleware...", name)
 
 	// It means the user is passing the URL directly
 	if config.URL != "" {
-		LoggerWARNING.Printf("Passing LDAP Server Attributes directly is deprecated, please use 'ServerList' instead")
+		config.logger.Warningf("Passing LDAP Server Attributes directly is deprecated, please use 'ServerList' instead")
 		server := LdapServerConfig{
 			URL:                  config.URL,
 			Port:                 config.Port,
@@ -146,14 +383,119 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		config.ServerList = append(config.ServerList, server)
 	}
 
-	// Rank LDAP servers based on weight. Higher weight, higher precedence
-	sort.Slice(config.ServerList, func(i, j int) bool {
-		return config.ServerList[i].Weight > config.ServerList[j].Weight
-	})
-
 	settingDefaults(config)
 
-	logConfigParams(config)
+	logConfigParams(config.logger, config)
+
+	if _, ok := collector.(*Metrics); config.MetricsPath != "" && !ok {
+		config.logger.Warningf("Metrics are reported to the injected collector, '%s' is not served", config.MetricsPath)
+	}
+
+	if config.ClientCertAuth && config.ClientCertTrustHeader {
+		config.clientCertPool = x509.NewCertPool()
+		if !config.clientCertPool.AppendCertsFromPEM([]byte(config.ClientCertCA)) {
+			return nil, fmt.Errorf("clientCertTrustHeader needs the PEM encoded clientCertCa issuing the client certificates")
+		}
+	}
+
+	if config.GroupMembership != "search" && config.GroupMembership != "memberOf" {
+		return nil, fmt.Errorf("invalid groupMembership '%s'", config.GroupMembership)
+	}
+
+	// Without Realms the top level parameters are the only directory in use
+	realms := []*Config{config}
+	if len(config.Realms) > 0 {
+		realms = make([]*Config, 0, len(config.Realms))
+		for i, realm := range config.Realms {
+			if realm.Name == "" {
+				realm.Name = fmt.Sprintf("realm%d", i)
+			}
+			if len(realm.ServerList) == 0 {
+				return nil, fmt.Errorf("realm '%s' has an empty ServerList", realm.Name)
+			}
+			if realm.GroupMembership != "" && realm.GroupMembership != "search" && realm.GroupMembership != "memberOf" {
+				return nil, fmt.Errorf("realm '%s' has an invalid groupMembership '%s'", realm.Name, realm.GroupMembership)
+			}
+			realms = append(realms, newRealmConfig(config, realm))
+		}
+	}
+
+	if err := CompileRules(config.Rules); err != nil {
+		return nil, err
+	}
+
+	// Sessions are revalidated without the user password, so only with the service account.
+	if config.CacheRevalidateInterval > 0 {
+		for _, rc := range realms {
+			if rc.BindDN == "" {
+				return nil, fmt.Errorf("cacheRevalidateInterval needs a bindDN, missing in realm '%s'", rc.Realm)
+			}
+		}
+	}
+
+	for _, ah := range config.ForwardAttributes {
+		if ah.Attribute == "" || ah.Header == "" {
+			return nil, fmt.Errorf("forwardAttributes entries need both an attribute and a header")
+		}
+		if ah.Encoding != "raw" && ah.Encoding != "base64" && ah.Encoding != "rfc2047" {
+			return nil, fmt.Errorf("attribute '%s' has an invalid encoding '%s'", ah.Attribute, ah.Encoding)
+		}
+	}
+
+	attributeNames := append([]string{}, config.JwtAttributes...)
+	for _, ah := range config.ForwardAttributes {
+		attributeNames = append(attributeNames, ah.Attribute)
+	}
+	for _, name := range attributeNames {
+		if _, decoder := SplitAttributeDecoder(name); decoder != "" && attributeDecoders[decoder] == nil {
+			return nil, fmt.Errorf("attribute '%s' has an invalid decoder '%s'", name, decoder)
+		}
+	}
+
+	if config.ForwardGroups {
+		if config.ForwardGroupsFormat != "delimited" && config.ForwardGroupsFormat != "json" {
+			return nil, fmt.Errorf("invalid forwardGroupsFormat '%s'", config.ForwardGroupsFormat)
+		}
+		if config.ForwardGroupsFilter != "" {
+			var err error
+			if config.forwardGroupsRegexp, err = regexp.Compile(config.ForwardGroupsFilter); err != nil {
+				return nil, fmt.Errorf("invalid forwardGroupsFilter: %w", err)
+			}
+		}
+	}
+
+	var jwtKey interface{}
+	if config.ForwardJwt {
+		var err error
+		if jwtKey, err = LoadJwtKey(config); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, rc := range realms {
+		rc.groupResolver = &groupResolver{groups: map[string]resolvedGroup{}}
+	}
+
+	if config.LocalUsersMode != "unreachable" && config.LocalUsersMode != "fallback" {
+		return nil, fmt.Errorf("invalid localUsersMode '%s'", config.LocalUsersMode)
+	}
+
+	if config.ApiKeyHashFormat != "hex" && config.ApiKeyHashFormat != "ldap" {
+		return nil, fmt.Errorf("invalid apiKeyHashFormat '%s'", config.ApiKeyHashFormat)
+	}
+
+	if config.PasswordChangeMode != "passwordModify" && config.PasswordChangeMode != "activeDirectory" {
+		return nil, fmt.Errorf("invalid passwordChangeMode '%s'", config.PasswordChangeMode)
+	}
+
+	var localUsers map[string]LocalUser
+	if config.LocalUsersFile != "" {
+		var err error
+		if localUsers, err = LoadLocalUsers(config.LocalUsersFile); err != nil {
+			return nil, err
+		}
+		config.logger.Warningf("Loaded %d local users from '%s' used when LDAP is %s", len(localUsers), config.LocalUsersFile, config.LocalUsersMode)
+	}
 
 	// Create new session with CacheKey and CacheTimeout.
 	var key []byte
@@ -165,10 +507,17 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 			return nil, fmt.Errorf("Error generating random key")
 		}
 	}
-	store = sessions.NewCookieStore(key)
+	maxAge := int(config.CacheTimeout)
+	if config.CacheIdleTimeout > 0 {
+		// Cookies are re-issued on activity, so they only need to outlive the idle timeout.
+		maxAge = int(config.CacheIdleTimeout)
+	}
+
+	// Each instance has its own store, so its key and cookie options don't leak to the others.
+	store := sessions.NewCookieStore(key)
 	store.Options = &sessions.Options{
 		HttpOnly: true,
-		MaxAge:   int(config.CacheTimeout),
+		MaxAge:   maxAge,
 		Path:     config.CacheCookiePath,
 		Secure:   config.CacheCookieSecure,
 	}
@@ -179,110 +528,383 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	// 30 days.
 	store.MaxAge(store.Options.MaxAge)
 
-	return &LdapAuth{
-		name:   name,
-		next:   next,
-		config: config,
-	}, nil
+	// Resolve group names at startup without delaying it when the LDAP servers are slow or down,
+	// then keep them fresh until the middleware is replaced.
+	for _, rc := range realms {
+		go RefreshGroupNames(ctx, rc, GroupSpecs(rc, config.Rules))
+	}
+
+	for _, rc := range realms {
+		for _, server := range rc.ServerList {
+			for _, version := range []string{server.MinVersionTLS, server.MaxVersionTLS} {
+				if _, ok := tlsVersions[version]; !ok {
+					config.logger.Warningf("Version: '%s' doesnt match any value. Using 'tls.VersionTLS10' instead", version)
+					config.logger.Warningf("Please check https://pkg.go.dev/crypto/tls#pkg-constants to a list of valid versions")
+				}
+			}
+		}
+	}
+
+	la := &LdapAuth{
+		name:       name,
+		next:       next,
+		config:     config,
+		logger:     config.logger,
+		realms:     realms,
+		localUsers: localUsers,
+		jwtKey:     jwtKey,
+		store:      store,
+	}
+
+	if config.CredentialCacheTTL > 0 {
+		la.credentialCache = NewTTLCache(int(config.CredentialCacheSize), time.Duration(config.CredentialCacheTTL)*time.Second)
+	}
+	if config.NegativeCacheTTL > 0 {
+		la.negativeCache = NewTTLCache(int(config.NegativeCacheSize), time.Duration(config.NegativeCacheTTL)*time.Second)
+	}
+	if config.AuditLogFile != "" || config.AuditSyslogAddress != "" {
+		if config.AuditBufferSize == 0 {
+			return nil, fmt.Errorf("auditBufferSize must be greater than 0")
+		}
+		sinks := []AuditSink{}
+		if config.AuditLogFile != "" {
+			sinks = append(sinks, &FileAuditSink{Path: config.AuditLogFile})
+		}
+		if config.AuditSyslogAddress != "" {
+			sink, err := NewSyslogAuditSink(config.AuditSyslogAddress)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		}
+		la.audit = NewAuditLogger(ctx, config.logger, int(config.AuditBufferSize), sinks...)
+	}
+	if la.credentialCache != nil || la.negativeCache != nil {
+		// A random key per instance, so cache keys can't be computed from guessed passwords.
+		la.hashKey = securecookie.GenerateRandomKey(32)
+		if la.hashKey == nil {
+			return nil, fmt.Errorf("Error generating random key")
+		}
+	}
+
+	return la, nil
 }
 
 func (la *LdapAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(context.WithValue(req.Context(), requestStartKey{}, time.Now()))
+
 	if !la.config.Enabled {
-		LoggerINFO.Printf("%s Disabled! Passing request...", la.name)
+		la.logger.Infof("%s Disabled! Passing request...", la.name)
 		la.next.ServeHTTP(rw, req)
 		return
 	}
 
+	if la.config.MetricsPublic && la.serveMetrics(rw, req) {
+		return
+	}
+
+	// Password policy headers are only set by ldapAuth, never trust those sent by the client.
+	req.Header.Del("Ldap-Password-Expire")
+	req.Header.Del("Ldap-Password-Grace")
+
 	var err error
 
-	session, _ := store.Get(req, la.config.CacheCookieName)
-	LoggerDEBUG.Printf("Session details: %v", session)
+	session, _ := la.store.Get(req, la.config.CacheCookieName)
+	la.logger.Debugf("Session details: %v", session)
+
+	if la.config.PasswordChangePath != "" && req.URL.Path == la.config.PasswordChangePath {
+		la.servePasswordChange(rw, req, session)
+		return
+	}
+
+	rule := MatchRule(la.config.Rules, req)
+	if rule != nil {
+		la.logger.Infof("Request '%s %s%s' matches rule '%s'", req.Method, req.Host, req.URL.Path, rule.Name)
+	}
+
+	if apiKey := GetApiKey(req, la.config); apiKey != "" {
+		la.serveApiKey(rw, req, session, apiKey, rule)
+		return
+	}
+
+	if la.config.ClientCertAuth {
+		cert, err := GetClientCertificate(req, la.config)
+		if err != nil {
+			la.recordAuth(req, "certificate", rule, "", "", nil, err)
+			RequireAuth(rw, req, la.config, "", err)
+			return
+		}
+		if cert != nil {
+			la.serveClientCert(rw, req, session, cert, rule)
+			return
+		}
+		la.logger.Debugf("No client certificate found, trying Basic authentication")
+	}
 
 	username, password, ok := req.BasicAuth()
 	username = strings.ToLower(username)
 
-	la.config.Username = username
-
 	if !ok {
-		err = errors.New("no valid 'Authorization: Basic xxxx' header found in request")
-		RequireAuth(rw, req, la.config, err)
+		err = &AuthError{Reason: ReasonMissingCredentials, Message: "no valid 'Authorization: Basic xxxx' header found in request"}
+		// Not an authentication attempt, so only audited.
+		la.auditDenial(req, "basic", rule, "", "", nil, err)
+		RequireAuth(rw, req, la.config, "", err)
 		return
 	}
 
+	// Cached credentials are keyed by the realms they were checked against.
+	realms, realmUsername := la.selectRealms(username, rule)
+	realmKey := RealmNames(realms)
+
+	revoked := false
 	if auth, ok := session.Values["authenticated"].(bool); ok && auth {
-		if session.Values["username"] == username {
-			LoggerDEBUG.Printf("Session token Valid! Passing request...")
-			ServeAuthenicated(la, session, rw, req)
+		if session.Values["username"] != username {
+			err = fmt.Errorf("session user: '%s' != Auth user: '%s'. Please, reauthenticate", session.Values["username"], username)
+			// Invalidate session.
+			session.Values["authenticated"] = false
+			session.Values["username"] = username
+			session.Options.MaxAge = -1
+			session.Save(req, rw)
+			la.recordAuth(req, "ldap", rule, username, "", nil, err)
+			RequireAuth(rw, req, la.config, username, err)
 			return
 		}
-		err = fmt.Errorf("session user: '%s' != Auth user: '%s'. Please, reauthenticate", session.Values["username"], username)
-		// Invalidate session.
-		session.Values["authenticated"] = false
-		session.Values["username"] = username
-		session.Options.MaxAge = -1
-		session.Save(req, rw)
-		RequireAuth(rw, req, la.config, err)
-		return
+		if !SessionRuleAllowed(session, rule) {
+			la.logger.Debugf("Session not authorized for rule '%s'! Trying to authorize in LDAP", RuleName(rule))
+		} else if err = la.checkSession(rw, req, session, rule); err != nil {
+			la.logger.Warningf("Session of user '%s' revoked: %s", username, err)
+			if errors.Is(err, ErrSessionRevoked) {
+				if la.credentialCache != nil {
+					la.credentialCache.Remove(CredentialKey(la.hashKey, RuleName(rule), realmKey, username, password))
+				}
+				server, _ := session.Values["ldap-server"].(string)
+				la.recordAuth(req, "ldap", rule, username, server, nil, err)
+				RequireAuth(rw, req, la.config, username, err)
+				return
+			}
+			la.logger.Debugf("Trying to authenticate in LDAP")
+			revoked = true
+		} else {
+			la.logger.Debugf("Session token Valid! Passing request...")
+			la.config.metrics.inc(MetricCacheRequests, "cache", "session", "result", "hit")
+			ServeAuthenicated(la, session, rw, req, rule, sessionGrantedGroup(session, rule))
+			return
+		}
+	} else {
+		la.logger.Debugf("No session found! Trying to authenticate in LDAP")
+	}
+	la.config.metrics.inc(MetricCacheRequests, "cache", "session", "result", "miss")
+
+	var credentialKey string
+	if la.credentialCache != nil {
+		credentialKey = CredentialKey(la.hashKey, RuleName(rule), realmKey, username, password)
+		if revoked {
+			la.credentialCache.Remove(credentialKey)
+		} else if cached, ok := la.credentialCache.Get(credentialKey); ok {
+			la.logger.Debugf("Credentials of user '%s' found in cache! Passing request...", username)
+			la.config.metrics.inc(MetricCacheRequests, "cache", "credential", "result", "hit")
+			credential := cached.(cachedCredential)
+			la.serveLdapEntry(rw, req, session, rule, username, credential.realm, credential.server, credential.entry)
+			return
+		}
+		la.config.metrics.inc(MetricCacheRequests, "cache", "credential", "result", "miss")
 	}
 
-	LoggerDEBUG.Println("No session found! Trying to authenticate in LDAP")
+	errStrings := []string{}
 
-	var conn *ldap.Conn = nil
-	var serverInUse LdapServerConfig
-	errStrings := []string{"All servers in ServerList are down"}
+	var entry *ldap.Entry
+	var server string
+	var warning *PasswordPolicyWarning
+	var realm *Config
+	serversDown := true
+	// The last failure, whose reason is lost in the joined error message.
+	var failure error
+
+	if err = la.negativeCacheGet(realmKey, username, password); err != nil {
+		la.logger.Debugf("Failed credentials of user '%s' found in cache", username)
+		failure = err
+		errStrings = append(errStrings, err.Error())
+		serversDown = false
+		realms = nil
+	}
 
-	for i, server := range la.config.ServerList {
-		attempt := fmt.Sprintf("Attempt %d/%d", i+1, len(la.config.ServerList))
-		LoggerDEBUG.Printf(attempt)
+	failures := []error{}
+	for _, rc := range realms {
+		var isValidUser bool
 
-		if conn, err = Connect(server); err == nil {
-			serverInUse = server
+		entry, server, warning, isValidUser, err = LdapAuthenticate(rc, realmUsername, password)
+		if err == nil {
+			realm = rc
 			break
 		}
+		failures = append(failures, err)
+		failure = err
 
-		LoggerERROR.Printf("%v", err)
-		errStrings = append(errStrings, fmt.Sprintf("%s: %v", attempt, err))
+		if !errors.Is(err, ErrServersDown) {
+			serversDown = false
+		}
+		if len(realms) > 1 {
+			err = fmt.Errorf("Realm '%s': %w", rc.Realm, err)
+		}
+		errStrings = append(errStrings, err.Error())
 
-		if i == len(la.config.ServerList)-1 {
-			err = fmt.Errorf(strings.Join(errStrings, "\n"))
-			RequireAuth(rw, req, la.config, err)
-			return
+		// User authenticated but was not authorized, so other realms are not tried.
+		if isValidUser {
+			break
 		}
 	}
 
-	isValidUser, entry, err := LdapCheckUser(conn, la.config, serverInUse, username, password)
+	if realm == nil && len(failures) > 0 {
+		la.negativeCacheAdd(realmKey, username, password, failures, strings.Join(errStrings, "\n"))
+	}
+
+	if realm == nil && la.localUsers != nil && (serversDown || la.config.LocalUsersMode == "fallback") {
+		la.logger.Warningf("BREAK-GLASS: LDAP authentication failed, checking user '%s' against local users file '%s'", username, la.config.LocalUsersFile)
+		var group string
+		if group, err = LocalCheckUser(la.localUsers, RuleConfig(la.config, rule), username, password); err == nil {
+			la.logger.Warningf("BREAK-GLASS: local user '%s' authenticated from '%s' to '%s%s'", username, req.RemoteAddr, req.Host, req.URL.Path)
 
-	if !isValidUser {
-		defer conn.Close()
-		LoggerERROR.Printf("%s", err)
-		LoggerERROR.Printf("Authentication failed")
-		RequireAuth(rw, req, la.config, err)
-		return
+			session.Values["username"] = username
+			session.Values["realm"] = ""
+			session.Values["auth-method"] = "local"
+			session.Values["ldap-dn"] = ""
+			session.Values["ldap-cn"] = username
+			session.Values["ldap-server"] = ""
+			SetSessionGroups(la.config, session, la.localUsers[username].Groups)
+			session.Values["authenticated"] = true
+			session.Values["validated-at"] = time.Now().Unix()
+			session.Values["created-at"] = time.Now().Unix()
+			sessionGrant(session, rule, group)
+			la.saveSession(rw, req, session)
+
+			la.recordAuth(req, "local", rule, username, "", nil, nil)
+			ServeAuthenicated(la, session, rw, req, rule, group)
+			return
+		}
+		la.logger.Warningf("BREAK-GLASS: local user '%s' rejected: %s", username, err)
+		errStrings = append(errStrings, err.Error())
 	}
 
-	isAuthorized, err := LdapCheckUserAuthorized(conn, la.config, entry, username)
-	if !isAuthorized {
-		defer conn.Close()
-		LoggerERROR.Printf("%s", err)
-		RequireAuth(rw, req, la.config, err)
+	if realm == nil {
+		err = errors.New(strings.Join(errStrings, "\n"))
+		if failure == nil {
+			failure = err
+		}
+		la.recordAuth(req, "ldap", rule, username, server, entry, failure)
+		RequireAuth(rw, req, la.config, username, err)
 		return
 	}
 
-	defer conn.Close()
+	la.logger.Infof("Authentication succeeded")
+
+	if warning != nil {
+		la.logger.Warningf("User '%s': %s", username, warning)
+		SetPasswordPolicyHeaders(rw, req, warning)
+	} else if la.credentialCache != nil {
+		// Password policy warnings must be sent again, so those credentials are not cached.
+		la.credentialCache.Add(credentialKey, cachedCredential{realm: realm.Realm, server: server, entry: entry})
+	}
 
-	LoggerINFO.Printf("Authentication succeeded")
+	la.serveLdapEntry(rw, req, session, rule, username, realm.Realm, server, entry)
+}
 
+// serveLdapEntry save the session of a user authenticated in realm by server, then serve the request.
+func (la *LdapAuth) serveLdapEntry(rw http.ResponseWriter, req *http.Request, session *sessions.Session, rule *AuthorizationRule, username, realm, server string, entry *ldap.Entry) {
 	// Set user as authenticated.
 	session.Values["username"] = username
+	session.Values["realm"] = realm
+	session.Values["auth-method"] = "ldap"
 	session.Values["ldap-dn"] = entry.DN
 	session.Values["ldap-cn"] = entry.GetAttributeValue("cn")
+	session.Values["ldap-server"] = server
+	SetSessionAttributes(la.config, session, entry)
+	SetSessionGroups(la.config, session, entry.GetAttributeValues(userGroupsAttribute))
 	session.Values["authenticated"] = true
-	session.Save(req, rw)
+	session.Values["validated-at"] = time.Now().Unix()
+	session.Values["created-at"] = time.Now().Unix()
+	group := entry.GetAttributeValue(grantedGroupAttribute)
+	sessionGrant(session, rule, group)
+	la.saveSession(rw, req, session)
+
+	la.recordAuth(req, "ldap", rule, username, server, entry, nil)
+	ServeAuthenicated(la, session, rw, req, rule, group)
+}
+
+// ConnectServerList return a connection to the first available server of config ServerList.
+func ConnectServerList(config *Config) (*ldap.Conn, LdapServerConfig, error) {
+	errStrings := []string{}
+
+	for i, server := range config.ServerList {
+		attempt := fmt.Sprintf("Attempt %d/%d", i+1, len(config.ServerList))
+		config.logger.Debugf("%s: '%s:%d'", attempt, server.URL, server.Port)
+
+		start := time.Now()
+		conn, err := Connect(server)
+		config.metrics.ldapOperation(server.URL, "connect", start)
+		if err == nil {
+			return conn, server, nil
+		}
+
+		config.logger.Errorf("%v", err)
+		if i+1 < len(config.ServerList) {
+			config.metrics.inc(MetricLdapFailovers, "server", server.URL)
+		}
+		errStrings = append(errStrings, fmt.Sprintf("%s: %v", attempt, err))
+	}
+
+	if len(errStrings) == 0 {
+		return nil, LdapServerConfig{}, ErrServersDown
+	}
+
+	return nil, LdapServerConfig{}, fmt.Errorf("%w\n%s", ErrServersDown, strings.Join(errStrings, "\n"))
+}
 
-	ServeAuthenicated(la, session, rw, req)
+// LdapAuthenticate connect to the first available server of config, then check if
+// user is valid and authorized. The URL of the server used is returned, and the returned bool
+// reports if the user was authenticated.
+func LdapAuthenticate(config *Config, username, password string) (*ldap.Entry, string, *PasswordPolicyWarning, bool, error) {
+	conn, serverInUse, err := ConnectServerList(config)
+	if err != nil {
+		return nil, "", nil, false, err
+	}
+
+	defer conn.Close()
+
+	if config.Realm != "" {
+		config.logger.Debugf("Using realm '%s'", config.Realm)
+	}
+
+	isValidUser, entry, err := LdapCheckUser(conn, config, serverInUse, username, password)
+	if !isValidUser {
+		config.logger.With(Fields{"username": username, "server": serverInUse.URL, "reason": FailureReason(err)}).
+			Errorf("Authentication failed (reason: %s)", FailureReason(err))
+		return nil, serverInUse.URL, nil, false, err
+	}
+	config.logger.With(Fields{"username": username, "server": serverInUse.URL}).Debugf("Credentials accepted")
+
+	// A valid user may carry password policy warnings.
+	var warning *PasswordPolicyWarning
+	errors.As(err, &warning)
+
+	isAuthorized, err := LdapCheckUserAuthorized(conn, config, entry, username)
+	if !isAuthorized {
+		config.logger.Errorf("%s", err)
+		return entry, serverInUse.URL, warning, true, err
+	}
+
+	if config.ForwardGroups {
+		AddUserGroups(conn, config, entry, username)
+	}
+
+	return entry, serverInUse.URL, warning, true, nil
 }
 
-func ServeAuthenicated(la *LdapAuth, session *sessions.Session, rw http.ResponseWriter, req *http.Request) {
+func ServeAuthenicated(la *LdapAuth, session *sessions.Session, rw http.ResponseWriter, req *http.Request, rule *AuthorizationRule, group string) {
+	// Never trust the realm header sent by the client.
+	if la.config.ForwardRealmHeader != "" {
+		req.Header.Del(la.config.ForwardRealmHeader)
+	}
+
 	// Sanitize Some Headers Infos.
 	if la.config.ForwardUsername {
 		username := session.Values["username"].(string)
@@ -290,7 +912,11 @@ func ServeAuthenicated(la *LdapAuth, session *sessions.Session, rw http.Response
 		req.URL.User = url.User(username)
 		req.Header[la.config.ForwardUsernameHeader] = []string{username}
 
-		if la.config.ForwardExtraLdapHeaders && la.config.SearchFilter != "" {
+		if realm, ok := session.Values["realm"].(string); ok && realm != "" && la.config.ForwardRealmHeader != "" {
+			req.Header.Set(la.config.ForwardRealmHeader, realm)
+		}
+
+		if la.config.ForwardExtraLdapHeaders {
 			userDN := session.Values["ldap-dn"].(string)
 			userCN := session.Values["ldap-cn"].(string)
 			req.Header["Ldap-Extra-Attr-DN"] = []string{userDN}
@@ -298,38 +924,137 @@ func ServeAuthenicated(la *LdapAuth, session *sessions.Session, rw http.Response
 		}
 	}
 
+	// Never trust attribute headers sent by the client.
+	for _, ah := range la.config.ForwardAttributes {
+		req.Header.Del(ah.Header)
+		if value, ok := session.Values["ldap-attr-"+ah.Attribute].(string); ok && value != "" {
+			req.Header.Set(ah.Header, value)
+		}
+	}
+
+	if la.config.ForwardGroups {
+		groups, _ := session.Values["groups"].([]string)
+		req.Header.Set(la.config.ForwardGroupsHeader, FormatGroups(la.config, groups))
+	}
+
+	if la.config.ForwardJwt {
+		req.Header.Del(la.config.JwtHeader)
+		token, err := SignJwt(la.config, la.jwtKey, JwtClaims(la.config, session, time.Now()))
+		if err != nil {
+			la.logger.Errorf("Unable to sign JWT: %s", err)
+		} else {
+			req.Header.Set(la.config.JwtHeader, token)
+		}
+	}
+
+	// The certificate header is only meant for ldapAuth, never trust it past this middleware.
+	if la.config.ClientCertAuth {
+		req.Header.Del(la.config.ClientCertHeader)
+	}
+
 	/*
 	 Prevent expose username and password on Header
 	 if ForwardAuthorization option is set.
 	*/
 	if !la.config.ForwardAuthorization {
 		req.Header.Del("Authorization")
+		if la.config.ApiKeyAttribute != "" {
+			req.Header.Del(la.config.ApiKeyHeader)
+		}
+	}
+
+	requestLogger(la.logger, req, la.config).With(Fields{
+		"username": session.Values["username"],
+		"realm":    session.Values["realm"],
+		"method":   session.Values["auth-method"],
+		"rules":    session.Values["rules"],
+		"group":    group,
+		"outcome":  "allowed",
+	}).Infof("Request allowed")
+
+	if la.audit != nil {
+		record := NewAuditRecord(la.name, req, rule, "allowed")
+		record.Group = group
+		record.Username, _ = session.Values["username"].(string)
+		record.DN, _ = session.Values["ldap-dn"].(string)
+		record.Realm, _ = session.Values["realm"].(string)
+		record.AuthMethod, _ = session.Values["auth-method"].(string)
+		record.Server, _ = session.Values["ldap-server"].(string)
+		la.audit.Record(record)
+	}
+
+	if la.serveMetrics(rw, req) {
+		return
 	}
 
 	la.next.ServeHTTP(rw, req)
 }
 
+// serveMetrics answer a request to MetricsPath with the metrics, instead of the backend, and
+// report if it did.
+func (la *LdapAuth) serveMetrics(rw http.ResponseWriter, req *http.Request) bool {
+	if la.config.MetricsPath == "" || req.URL.Path != la.config.MetricsPath {
+		return false
+	}
+
+	metrics, ok := la.config.metrics.collector.(*Metrics)
+	if !ok {
+		return false
+	}
+
+	metrics.ServeHTTP(rw, req)
+	return true
+}
+
 // LdapCheckUser check if user and password are correct.
 func LdapCheckUser(conn *ldap.Conn, config *Config, server LdapServerConfig, username, password string) (bool, *ldap.Entry, error) {
 	if config.SearchFilter == "" {
-		LoggerDEBUG.Printf("Running in Bind Mode")
-		userDN := fmt.Sprintf("%s=%s,%s", config.Attribute, username, config.BaseDN)
-		userDN = strings.Trim(userDN, ",")
-		LoggerDEBUG.Printf("Authenticating User: %s", userDN)
-		err := conn.Bind(userDN, password)
-		return err == nil, ldap.NewEntry(userDN, nil), err
+		config.logger.Debugf("Running in Bind Mode")
+		userDN := BindModeUserDN(config, username)
+		config.logger.Debugf("Authenticating User: %s", userDN)
+		start := time.Now()
+		warning, err := LdapBindUser(conn, config, userDN, password)
+		config.metrics.ldapOperation(server.URL, "bind", start)
+		entry := ldap.NewEntry(userDN, nil)
+		if err == nil {
+			// Bind Mode has no user entry, so read it as the bound user.
+			start = time.Now()
+			readEntry, readErr := LdapReadBoundEntry(conn, config, userDN)
+			config.metrics.ldapOperation(server.URL, "search", start)
+			switch {
+			case readErr == nil:
+				entry = readEntry
+			case BindEntryRequired(config):
+				err = fmt.Errorf("unable to read entry of User: '%s': %w", userDN, readErr)
+			default:
+				config.logger.Warningf("Unable to read entry of User: '%s': %s", userDN, readErr)
+			}
+		}
+		return bindResult(entry, warning, err)
 	}
 
-	LoggerDEBUG.Printf("Running in Search Mode")
+	config.logger.Debugf("Running in Search Mode")
 
-	result, err := SearchMode(conn, config)
+	start := time.Now()
+	result, err := SearchMode(conn, config, username)
+	config.metrics.ldapOperation(server.URL, "search", start)
 	// Return if search fails.
 	if err != nil {
 		return false, &ldap.Entry{}, err
 	}
 
 	userDN := result.Entries[0].DN
-	LoggerINFO.Printf("Authenticating User: %s", userDN)
+	config.logger.Infof("Authenticating User: %s", userDN)
+
+	// Refuse disabled or expired accounts before the bind counts as a bad password attempt. The
+	// password is unchecked, so the account state is only logged, not revealed to the client.
+	if config.ADAccountCheck {
+		if err = ADAccountState(result.Entries[0], time.Now()); err != nil {
+			config.logger.With(Fields{"username": username, "reason": FailureReason(err)}).Warningf("Refusing User '%s' before bind: %s", userDN, err)
+			invalid := adBindErrors["52e"]
+			return false, result.Entries[0], &invalid
+		}
+	}
 
 	// Create a new conn to validate user password. This prevents changing the bind made
 	// previously, then LdapCheckUserAuthorized will use same operation mode
@@ -337,68 +1062,641 @@ func LdapCheckUser(conn *ldap.Conn, config *Config, server LdapServerConfig, use
 	defer _nconn.Close()
 
 	// Bind User and password.
-	err = _nconn.Bind(userDN, password)
-	return err == nil, result.Entries[0], err
+	start = time.Now()
+	warning, err := LdapBindUser(_nconn, config, userDN, password)
+	config.metrics.ldapOperation(server.URL, "bind", start)
+	return bindResult(result.Entries[0], warning, err)
 }
 
-// LdapCheckUserAuthorized check if user is authorized post-authentication
-func LdapCheckUserAuthorized(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) (bool, error) {
-	// Check if authorization is required or simply authentication
-	if len(config.AllowedUsers) == 0 && len(config.AllowedGroups) == 0 {
-		LoggerDEBUG.Printf("No authorization requirements")
-		return true, nil
-	}
+// BindEntryRequired report if authorization needs the attributes of the user entry, so a user of
+// Bind Mode whose entry can't be read must be refused: memberOf and primary groups come from it.
+func BindEntryRequired(config *Config) bool {
+	return HasRequirements(config) && (config.GroupMembership == "memberOf" || config.PrimaryGroupResolution)
+}
 
-	// Check if user is explicitly allowed
-	if LdapCheckAllowedUsers(conn, config, entry, username) {
-		return true, nil
+// bindResult return LdapCheckUser values, keeping password policy warnings as error of a valid user.
+func bindResult(entry *ldap.Entry, warning *PasswordPolicyWarning, err error) (bool, *ldap.Entry, error) {
+	if err != nil {
+		return false, entry, err
 	}
+	if warning != nil {
+		return true, entry, warning
+	}
+	return true, entry, nil
+}
 
-	// Check if user is allowed through groups
-	isValidGroups, err := LdapCheckUserGroups(conn, config, entry, username)
-	if isValidGroups {
-		return true, err
+// LdapBindUser bind as userDN. If PasswordPolicyControl is set, the password policy control is
+// sent and its response is turned into an AuthError or a PasswordPolicyWarning.
+func LdapBindUser(conn *ldap.Conn, config *Config, userDN, password string) (*PasswordPolicyWarning, error) {
+	if !config.PasswordPolicyControl {
+		return nil, ADBindError(config, conn.Bind(userDN, password))
 	}
 
-	errMsg := fmt.Sprintf("User '%s' does not match any allowed users nor allowed groups.", username)
+	controls := []ldap.Control{ldap.NewControlBeheraPasswordPolicy()}
+	result, err := conn.SimpleBind(ldap.NewSimpleBindRequest(userDN, password, controls))
+	err = ADBindError(config, err)
 
-	if err != nil {
-		err = fmt.Errorf("%w\n%s", err, errMsg)
-	} else {
-		err = errors.New(errMsg)
+	var policy *ldap.ControlBeheraPasswordPolicy
+	if result != nil {
+		policy, _ = ldap.FindControl(result.Controls, ldap.ControlTypeBeheraPasswordPolicy).(*ldap.ControlBeheraPasswordPolicy)
+	}
+	if policy == nil {
+		return nil, err
 	}
 
-	return false, err
+	config.logger.Debugf("Password policy response for '%s': %s", userDN, policy)
+
+	return PasswordPolicyResult(config, policy, err)
 }
 
-// LdapCheckAllowedUsers check if user is explicitly allowed in AllowedUsers list
-func LdapCheckAllowedUsers(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) bool {
-	if len(config.AllowedUsers) == 0 {
-		return false
-	}
+// BindModeUserDN return the user DN used in Bind Mode, '<attribute>=<username>,<baseDN>'.
+func BindModeUserDN(config *Config, username string) string {
+	userDN := fmt.Sprintf("%s=%s,%s", config.Attribute, username, config.BaseDN)
+	return strings.Trim(userDN, ",")
+}
 
-	found := false
+// Authentication failure reasons.
+const (
+	ReasonInvalidCredentials = "invalid_credentials"
+	ReasonPasswordExpired    = "password_expired"
+	ReasonAccountLocked      = "account_locked"
+	ReasonMustChangePassword = "must_change_password"
+	ReasonAccountDisabled    = "account_disabled"
+	ReasonAccountExpired     = "account_expired"
+	ReasonLogonHours         = "logon_hours"
+	ReasonLogonWorkstation   = "logon_workstation"
+	ReasonUnknownUser        = "unknown_user"
+	ReasonServersDown        = "servers_down"
+	ReasonUnauthorized       = "unauthorized"
+	ReasonMissingCredentials = "missing_credentials"
+	ReasonUnknown            = "unknown"
+)
 
-	for _, u := range config.AllowedUsers {
-		lowerAllowedUser := strings.ToLower(u)
-		if lowerAllowedUser == username || lowerAllowedUser == strings.ToLower(entry.DN) {
-			LoggerDEBUG.Printf("User: '%s' explicitly allowed in AllowedUsers", entry.DN)
-			found = true
-		}
-	}
+// AuthError an authentication failure with a known reason and a user-friendly message.
+type AuthError struct {
+	Reason  string
+	Message string
+	Err     error
+}
 
-	return found
+func (e *AuthError) Error() string {
+	return e.Message
 }
 
-// LdapCheckUserGroups check if the is user is a member of any of the AllowedGroups list
-func LdapCheckUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) (bool, error) {
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
 
-	if len(config.AllowedGroups) == 0 {
-		return false, nil
+// AuthorizationError an authenticated user not matching the authorization requirements. Group is
+// the group that denied the user, or was missing, if a single one did.
+type AuthorizationError struct {
+	Group   string
+	Message string
+	Err     error
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s\n%s", e.Err, e.Message)
 	}
+	return e.Message
+}
 
-	found := false
-	err := error(nil)
+func (e *AuthorizationError) Unwrap() error {
+	return e.Err
+}
+
+// FailureReason return the reason of an AuthError, or ReasonUnknown for other errors.
+func FailureReason(err error) string {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.Reason
+	}
+	var authzErr *AuthorizationError
+	if errors.As(err, &authzErr) {
+		return ReasonUnauthorized
+	}
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return ReasonInvalidCredentials
+	case errors.Is(err, ErrEmptySearchResult):
+		return ReasonUnknownUser
+	case errors.Is(err, ErrServersDown):
+		return ReasonServersDown
+	}
+	return ReasonUnknown
+}
+
+// PasswordPolicyWarning a successful bind close to, or after, password expiration.
+type PasswordPolicyWarning struct {
+	Expire int64
+	Grace  int64
+}
+
+func (w *PasswordPolicyWarning) Error() string {
+	if w.Grace > 0 {
+		return fmt.Sprintf("password expired, %d grace logins remaining", w.Grace)
+	}
+	return fmt.Sprintf("password expires in %d seconds", w.Expire)
+}
+
+// PasswordPolicyResult turn the password policy control response of a bind into an AuthError,
+// a PasswordPolicyWarning, or the bind error itself.
+func PasswordPolicyResult(config *Config, policy *ldap.ControlBeheraPasswordPolicy, err error) (*PasswordPolicyWarning, error) {
+	changeHint := "Please contact your administrator."
+	if config.PasswordChangePath != "" {
+		changeHint = fmt.Sprintf("Please change it at '%s'.", config.PasswordChangePath)
+	}
+
+	switch policy.Error {
+	case ldap.BeheraPasswordExpired:
+		return nil, &AuthError{Reason: ReasonPasswordExpired, Message: "Your password has expired. " + changeHint, Err: err}
+	case ldap.BeheraAccountLocked:
+		return nil, &AuthError{Reason: ReasonAccountLocked, Message: "Your account is locked. Please contact your administrator.", Err: err}
+	case ldap.BeheraChangeAfterReset:
+		return nil, &AuthError{Reason: ReasonMustChangePassword, Message: "Your password must be changed before logging in. " + changeHint, Err: err}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Expire > 0 || policy.Grace > 0 {
+		return &PasswordPolicyWarning{Expire: policy.Expire, Grace: policy.Grace}, nil
+	}
+
+	return nil, nil
+}
+
+// SetPasswordPolicyHeaders add the password policy warning to the response and forwarded headers.
+func SetPasswordPolicyHeaders(rw http.ResponseWriter, req *http.Request, warning *PasswordPolicyWarning) {
+	if warning.Expire > 0 {
+		expire := strconv.FormatInt(warning.Expire, 10)
+		rw.Header().Set("Ldap-Password-Expire", expire)
+		req.Header.Set("Ldap-Password-Expire", expire)
+	}
+	if warning.Grace > 0 {
+		grace := strconv.FormatInt(warning.Grace, 10)
+		rw.Header().Set("Ldap-Password-Grace", grace)
+		req.Header.Set("Ldap-Password-Grace", grace)
+	}
+}
+
+// LdapCheckUserAuthorized check if user is authorized post-authentication
+func LdapCheckUserAuthorized(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) (bool, error) {
+	// Check if authorization is required or simply authentication
+	if !HasRequirements(config) {
+		config.logger.Debugf("No authorization requirements")
+		return true, nil
+	}
+
+	if config.NestedGroupResolution {
+		isMember := GroupListMember(func() ([]string, error) {
+			return LdapResolveUserGroups(conn, config, entry, username)
+		})
+		return checkEntryRequirements(config, entry, username, withGroupNames(conn, config, isMember))
+	}
+
+	var isMember func(group string) (bool, error)
+
+	if config.GroupMembership == "memberOf" {
+		isMember = func(group string) (bool, error) {
+			return EntryMemberOf(config, entry, group), nil
+		}
+	} else {
+		res, err := conn.WhoAmI(nil)
+		if err != nil {
+			config.logger.Errorf("Failed to call WhoAmI(): %s", err)
+		} else {
+			config.logger.Debugf("Using credential: '%s' for Search Groups", res.AuthzID)
+		}
+
+		isMember = func(group string) (bool, error) {
+			return LdapCheckUserGroup(conn, config, entry, username, group)
+		}
+	}
+
+	if config.PrimaryGroupResolution {
+		isMember = withPrimaryGroups(conn, config, entry, isMember)
+	}
+
+	return checkEntryRequirements(config, entry, username, withGroupNames(conn, config, isMember))
+}
+
+// grantedGroupAttribute the entry attribute holding the group that granted access to the user.
+const grantedGroupAttribute = "ldapAuth-granted-group"
+
+// checkEntryRequirements run CheckRequirements, keeping the group that granted access to the user
+// in the grantedGroupAttribute of entry, so it can be audited.
+func checkEntryRequirements(config *Config, entry *ldap.Entry, username string, isMember func(group string) (bool, error)) (bool, error) {
+	isAuthorized, group, err := CheckRequirements(config, entry, username, isMember)
+	if isAuthorized && group != "" {
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(grantedGroupAttribute, []string{group}))
+	}
+	return isAuthorized, err
+}
+
+// GroupListMember return an isMember func matching the groups returned by resolve, called once per
+// request on the first membership check. A resolve error is returned by every check.
+func GroupListMember(resolve func() ([]string, error)) func(group string) (bool, error) {
+	var groups map[string]bool
+	var err error
+
+	return func(group string) (bool, error) {
+		if groups == nil && err == nil {
+			var list []string
+			if list, err = resolve(); err == nil {
+				groups = map[string]bool{}
+				for _, g := range list {
+					groups[NormalizeDN(g)] = true
+				}
+			}
+		}
+		return groups[NormalizeDN(group)], err
+	}
+}
+
+// withPrimaryGroups wrap isMember, also matching the user primary groups, resolved once on the
+// first membership check. A resolve error is returned by every check, so the user is denied.
+func withPrimaryGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, isMember func(group string) (bool, error)) func(group string) (bool, error) {
+	var primaryGroups []string
+	var err error
+	resolved := false
+
+	return func(group string) (bool, error) {
+		if !resolved {
+			resolved = true
+			if primaryGroups, err = LdapPrimaryGroups(conn, config, entry); err != nil {
+				err = fmt.Errorf("unable to resolve primary groups of User: '%s': %w", entry.DN, err)
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+
+		for _, g := range primaryGroups {
+			if DNEqual(g, group) {
+				config.logger.Debugf("User: '%s' found in primary Group: '%s'", entry.DN, group)
+				return true, nil
+			}
+		}
+
+		return isMember(group)
+	}
+}
+
+// HasRequirements check if any authorization requirement is configured.
+func HasRequirements(config *Config) bool {
+	return len(config.AllowedUsers) > 0 || len(config.AllowedGroups) > 0 || !config.Requirements.isEmpty()
+}
+
+func (r RequirementsConfig) isEmpty() bool {
+	return len(r.AllOfGroups) == 0 && len(r.AnyOfGroups) == 0 && len(r.DenyGroups) == 0 && len(r.DenyUsers) == 0
+}
+
+// CheckRequirements evaluate DenyUsers, DenyGroups, AllowedUsers, AllOfGroups and AnyOfGroups,
+// where AllowedGroups is part of AnyOfGroups, using isMember to check group membership. The
+// returned group is the one that granted access, if a single one did.
+func CheckRequirements(config *Config, entry *ldap.Entry, username string, isMember func(group string) (bool, error)) (bool, string, error) {
+	requirements := config.Requirements
+
+	// Deny requirements take precedence over any allow.
+	for _, u := range requirements.DenyUsers {
+		if strings.EqualFold(u, username) || strings.EqualFold(u, entry.DN) {
+			return false, "", &AuthorizationError{Message: fmt.Sprintf("User '%s' is explicitly denied.", username)}
+		}
+	}
+
+	for _, g := range requirements.DenyGroups {
+		member, err := isMember(g)
+		if err != nil {
+			// Membership is unknown, so deny.
+			return false, "", &AuthorizationError{Group: g, Message: fmt.Sprintf("Unable to check denied group '%s' for User '%s'.", g, username), Err: err}
+		}
+		if member {
+			return false, "", &AuthorizationError{Group: g, Message: fmt.Sprintf("User '%s' is a member of denied group '%s'.", username, g)}
+		}
+	}
+
+	anyOf := append(append([]string{}, config.AllowedGroups...), requirements.AnyOfGroups...)
+
+	if len(config.AllowedUsers) == 0 && len(anyOf) == 0 && len(requirements.AllOfGroups) == 0 {
+		return true, "", nil
+	}
+
+	// Check if user is explicitly allowed
+	if LdapCheckAllowedUsers(nil, config, entry, username) {
+		return true, "", nil
+	}
+
+	errMsg := fmt.Sprintf("User '%s' does not match any allowed users nor allowed groups.", username)
+
+	if len(anyOf) == 0 && len(requirements.AllOfGroups) == 0 {
+		return false, "", &AuthorizationError{Message: errMsg}
+	}
+
+	for _, g := range requirements.AllOfGroups {
+		member, err := isMember(g)
+		if !member {
+			errMsg = fmt.Sprintf("User '%s' is not a member of required group '%s'.", username, g)
+			return false, "", &AuthorizationError{Group: g, Message: errMsg, Err: err}
+		}
+	}
+
+	if len(anyOf) == 0 {
+		if len(requirements.AllOfGroups) == 1 {
+			return true, requirements.AllOfGroups[0], nil
+		}
+		return true, "", nil
+	}
+
+	var err error
+	for _, g := range anyOf {
+		var member bool
+		// Found one group that user belongs, stop searching.
+		if member, err = isMember(g); member {
+			return true, g, nil
+		}
+	}
+
+	return false, "", &AuthorizationError{Message: errMsg, Err: err}
+}
+
+// LdapCheckAllowedUsers check if user is explicitly allowed in AllowedUsers list
+func LdapCheckAllowedUsers(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) bool {
+	if len(config.AllowedUsers) == 0 {
+		return false
+	}
+
+	found := false
+
+	for _, u := range config.AllowedUsers {
+		lowerAllowedUser := strings.ToLower(u)
+		if lowerAllowedUser == username || lowerAllowedUser == strings.ToLower(entry.DN) {
+			config.logger.Debugf("User: '%s' explicitly allowed in AllowedUsers", entry.DN)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// LdapCheckUserGroups check if the is user is a member of any of the AllowedGroups list
+func LdapCheckUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) (bool, error) {
+
+	if len(config.AllowedGroups) == 0 {
+		return false, nil
+	}
+
+	found := false
+	err := error(nil)
+
+	for _, g := range config.AllowedGroups {
+		// Found one group that user belongs, break loop.
+		if found, err = LdapCheckUserGroup(conn, config, entry, username, g); found {
+			break
+		}
+	}
+
+	return found, err
+}
+
+// EntryMemberOf check if group is one of the MemberOfAttribute values of entry
+func EntryMemberOf(config *Config, entry *ldap.Entry, group string) bool {
+	for _, g := range entry.GetAttributeValues(config.MemberOfAttribute) {
+		if DNEqual(g, group) {
+			config.logger.Debugf("User: '%s' found in Group: '%s'", entry.DN, group)
+			return true
+		}
+	}
+
+	config.logger.Debugf("User: '%s' not found in Group: '%s'", entry.DN, group)
+
+	return false
+}
+
+// NormalizeDN return a lower case DN without extra spacing, or the lower case string if it
+// can't be parsed.
+func NormalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
+
+// DNEqual compare two DNs ignoring case and spacing, falling back to a string comparison if
+// any of them can't be parsed.
+func DNEqual(a, b string) bool {
+	dnA, errA := ldap.ParseDN(a)
+	dnB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return dnA.EqualFold(dnB)
+}
+
+// LdapResolveUserGroups return the DNs of the groups the user belongs to, directly or through
+// nested groups up to NestedGroupMaxDepth levels, walking group membership upward from the user.
+func LdapResolveUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) ([]string, error) {
+	var frontier []string
+	var err error
+
+	if config.GroupMembership == "memberOf" {
+		frontier = entry.GetAttributeValues(config.MemberOfAttribute)
+	} else {
+		userFilter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+			ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(username))
+		if frontier, err = LdapSearchGroups(conn, config, userFilter); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PrimaryGroupResolution {
+		primaryGroups, err := LdapPrimaryGroups(conn, config, entry)
+		if err != nil {
+			return nil, err
+		}
+		frontier = append(frontier, primaryGroups...)
+	}
+
+	groups, err := NestedGroups(config, entry.DN, frontier, func(filter string) ([]string, error) {
+		return LdapSearchGroups(conn, config, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config.logger.Debugf("User: '%s' groups: %v", entry.DN, groups)
+
+	return groups, nil
+}
+
+// NestedGroups return the groups of frontier and the groups they are nested in, up to
+// NestedGroupMaxDepth levels, using search to find the parents matching a member filter.
+func NestedGroups(config *Config, userDN string, frontier []string, search func(filter string) ([]string, error)) ([]string, error) {
+	groups := []string{}
+	visited := map[string]bool{}
+
+	for depth := uint(0); len(frontier) > 0; depth++ {
+		next := []string{}
+		for _, g := range frontier {
+			// Skip groups already found, breaking membership cycles.
+			if key := NormalizeDN(g); !visited[key] {
+				visited[key] = true
+				groups = append(groups, g)
+				next = append(next, g)
+			}
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		if depth >= config.NestedGroupMaxDepth {
+			config.logger.Warningf("Nested groups of User: '%s' exceed NestedGroupMaxDepth (%d)", userDN, config.NestedGroupMaxDepth)
+			break
+		}
+
+		frontier = []string{}
+		// Search parents in batches, keeping filters at a reasonable size.
+		for i := 0; i < len(next); i += 50 {
+			end := i + 50
+			if end > len(next) {
+				end = len(next)
+			}
+
+			var filter strings.Builder
+			filter.WriteString("(|")
+			for _, g := range next[i:end] {
+				fmt.Fprintf(&filter, "(member=%s)(uniqueMember=%s)", ldap.EscapeFilter(g), ldap.EscapeFilter(g))
+			}
+			filter.WriteString(")")
+
+			parents, err := search(filter.String())
+			if err != nil {
+				return nil, err
+			}
+			frontier = append(frontier, parents...)
+		}
+	}
+
+	return groups, nil
+}
+
+// LdapPrimaryGroups return the DNs of the user primary groups, which are not listed in the group
+// members: the Active Directory group whose objectSid is the user domain SID plus primaryGroupID,
+// and the POSIX group with the user gidNumber.
+func LdapPrimaryGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry) ([]string, error) {
+	filters := []string{}
+
+	if rid := entry.GetAttributeValue("primaryGroupID"); rid != "" {
+		groupSid, err := PrimaryGroupSID(entry.GetRawAttributeValue("objectSid"), rid)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, "(objectSid="+EscapeFilterBytes(groupSid)+")")
+	}
+
+	if gid := entry.GetAttributeValue("gidNumber"); gid != "" {
+		filters = append(filters, "(&(objectClass=posixGroup)(gidNumber="+ldap.EscapeFilter(gid)+"))")
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	groups, err := LdapSearchGroups(conn, config, "(|"+strings.Join(filters, "")+")")
+	if err != nil {
+		return nil, err
+	}
+
+	config.logger.Debugf("User: '%s' primary groups: %v", entry.DN, groups)
+
+	return groups, nil
+}
+
+// PrimaryGroupSID return the binary SID of the primary group, replacing the RID of the binary
+// user SID with primaryGroupID.
+func PrimaryGroupSID(userSid []byte, primaryGroupID string) ([]byte, error) {
+	if _, err := DecodeSID(userSid); err != nil {
+		return nil, err
+	}
+
+	rid, err := strconv.ParseUint(primaryGroupID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primaryGroupID '%s': %w", primaryGroupID, err)
+	}
+
+	groupSid := append([]byte{}, userSid...)
+	binary.LittleEndian.PutUint32(groupSid[len(groupSid)-4:], uint32(rid))
+
+	return groupSid, nil
+}
+
+// DecodeSID return the 'S-1-5-21-...' string of a binary Windows SID.
+func DecodeSID(sid []byte) (string, error) {
+	if len(sid) < 8 || len(sid) != 8+4*int(sid[1]) {
+		return "", fmt.Errorf("invalid SID of %d bytes", len(sid))
+	}
+
+	var authority uint64
+	for _, b := range sid[2:8] {
+		authority = authority<<8 | uint64(b)
+	}
+
+	out := fmt.Sprintf("S-%d-%d", sid[0], authority)
+	for i := 8; i < len(sid); i += 4 {
+		out += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(sid[i:i+4]))
+	}
+
+	return out, nil
+}
+
+// EscapeFilterBytes escape every byte of a binary value to be used in a filter.
+func EscapeFilterBytes(value []byte) string {
+	var out strings.Builder
+	for _, b := range value {
+		fmt.Fprintf(&out, "\\%02x", b)
+	}
+	return out.String()
+}
+
+// LdapSearchGroups return the DNs of the groups under GroupBaseDN, or BaseDN, matching filter.
+func LdapSearchGroups(conn *ldap.Conn, config *Config, filter string) ([]string, error) {
+	baseDN := config.GroupBaseDN
+	if baseDN == "" {
+		baseDN = config.BaseDN
+	}
+
+	config.logger.Debugf("Group Filter: '%s'", filter)
+
+	search := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		[]string{"dn"},
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, fmt.Errorf("Group search error: %w", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		groups = append(groups, e.DN)
+	}
+
+	return groups, nil
+}
+
+// LdapCheckUserGroup check if the user is a member of group
+func LdapCheckUserGroup(conn *ldap.Conn, config *Config, entry *ldap.Entry, username, group string) (bool, error) {
 	var group_filter bytes.Buffer
 
 	templ := "(|" +
@@ -410,292 +1708,2996 @@ func LdapCheckUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, use
 		"{{end}}" +
 		")"
 
-	template.Must(template.New("group_filter_template").
-		Parse(templ)).
-		Execute(&group_filter, struct {
-			UserDN                  string
-			Username                string
-			EnableNestedGroupFilter bool
-		}{ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(username), config.EnableNestedGroupFilter})
+	template.Must(template.New("group_filter_template").
+		Parse(templ)).
+		Execute(&group_filter, struct {
+			UserDN                  string
+			Username                string
+			EnableNestedGroupFilter bool
+		}{ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(username), config.EnableNestedGroupFilter})
+
+	config.logger.Debugf("Group Filter: '%s'", group_filter.String())
+
+	config.logger.Debugf("Searching Group: '%s' with User: '%s'", group, entry.DN)
+
+	search := ldap.NewSearchRequest(
+		group,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		group_filter.String(),
+		[]string{"member", "uniqueMember", "memberUid"},
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		config.logger.Infof("%s", err)
+		return false, err
+	}
+
+	if len(result.Entries) > 0 {
+		config.logger.Debugf("User: '%s' found in Group: '%s'", entry.DN, group)
+		return true, nil
+	}
+
+	config.logger.Debugf("User: '%s' not found in Group: '%s'", username, group)
+
+	return false, nil
+}
+
+// RequireAuth set Auth request.
+func RequireAuth(w http.ResponseWriter, req *http.Request, config *Config, username string, err error) {
+	config.logger.Debugf("%s", err)
+	requestLogger(config.logger, req, config).With(Fields{"username": username, "outcome": "denied"}).Infof("Request denied")
+	w.Header().Set("Content-Type", "text/plain")
+	if config.WWWAuthenticateHeader {
+		wwwHeaderContent := "Basic"
+		if config.WWWAuthenticateHeaderRealm != "" {
+			wwwHeaderContent = fmt.Sprintf("Basic realm=\"%s\"", config.WWWAuthenticateHeaderRealm)
+		}
+		w.Header().Set("WWW-Authenticate", wwwHeaderContent)
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+
+	errMsg := strings.Trim(err.Error(), "\x00")
+	_, _ = w.Write([]byte(fmt.Sprintf("%d %s\nError: %s\n", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), errMsg)))
+}
+
+// Connect return a LDAP Connection.
+func Connect(config LdapServerConfig) (*ldap.Conn, error) {
+	var conn *ldap.Conn = nil
+	var certPool *x509.CertPool
+	var err error = nil
+
+	if config.CertificateAuthority != "" {
+		certPool = x509.NewCertPool()
+		certPool.AppendCertsFromPEM([]byte(config.CertificateAuthority))
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// we assume that error is due to missing port.
+		host = u.Host
+	}
+
+	address := u.Scheme + "://" + net.JoinHostPort(host, strconv.FormatUint(uint64(config.Port), 10))
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         host,
+		RootCAs:            certPool,
+		MinVersion:         parseTlsVersion(config.MinVersionTLS),
+		MaxVersion:         parseTlsVersion(config.MaxVersionTLS),
+	}
+
+	if u.Scheme == "ldap" && config.StartTLS {
+		conn, err = ldap.DialURL(address)
+		if err == nil {
+			err = conn.StartTLS(tlsCfg)
+		}
+	} else if u.Scheme == "ldaps" {
+		conn, err = ldap.DialURL(address, ldap.DialWithTLSConfig(tlsCfg))
+	} else {
+		conn, err = ldap.DialURL(address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// SearchMode make search to LDAP for username and return results.
+func SearchMode(conn *ldap.Conn, config *Config, username string) (*ldap.SearchResult, error) {
+	return SearchModeFilter(conn, FilterData{Config: config, Username: username}, config.SearchFilter)
+}
+
+// SearchModeFilter make search to LDAP using filter template, executed with data, and return results.
+func SearchModeFilter(conn *ldap.Conn, data FilterData, filter string) (*ldap.SearchResult, error) {
+	config := data.Config
+
+	if config.BindDN != "" && config.BindPassword != "" {
+		config.logger.Debugf("Performing User BindDN Search")
+		err := conn.Bind(config.BindDN, config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("BindDN Error: %w", err)
+		}
+	} else {
+		config.logger.Debugf("Performing AnonymousBind Search")
+		_ = conn.UnauthenticatedBind("")
+	}
+
+	parsedSearchFilter, err := ParseFilter(filter, data)
+	config.logger.Debugf("Search Filter: '%s'", parsedSearchFilter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	search := ldap.NewSearchRequest(
+		config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		parsedSearchFilter,
+		UserAttributes(config),
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		config.logger.Errorf("Search Filter Error")
+		return nil, err
+	}
+
+	switch {
+	case len(result.Entries) == 1:
+		return result, nil
+	case len(result.Entries) < 1:
+		return nil, ErrEmptySearchResult
+	default:
+		return nil, fmt.Errorf(fmt.Sprintf("search filter return multiple entries (%d)", len(result.Entries)))
+	}
+}
+
+// LdapReadBoundEntry read the entry of the user bound as userDN. If userDN isn't the entry DN,
+// like when the server maps the bind name, the DN returned by WhoAmI is read instead.
+func LdapReadBoundEntry(conn *ldap.Conn, config *Config, userDN string) (*ldap.Entry, error) {
+	entry, err := LdapReadEntry(conn, config, userDN)
+	if err == nil {
+		return entry, nil
+	}
+
+	res, whoAmIErr := conn.WhoAmI(nil)
+	if whoAmIErr != nil || !strings.HasPrefix(res.AuthzID, "dn:") {
+		return nil, err
+	}
+
+	boundDN := strings.TrimPrefix(res.AuthzID, "dn:")
+	if DNEqual(boundDN, userDN) {
+		return nil, err
+	}
+	config.logger.Debugf("User: '%s' bound as: '%s'", userDN, boundDN)
+
+	return LdapReadEntry(conn, config, boundDN)
+}
+
+// LdapReadEntry read the entry of dn, with UserAttributes, using a base object search.
+func LdapReadEntry(conn *ldap.Conn, config *Config, dn string) (*ldap.Entry, error) {
+	search := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		"(objectClass=*)",
+		UserAttributes(config),
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("entry '%s' not found", dn)
+	}
+
+	return result.Entries[0], nil
+}
+
+// UserAttributes return the attributes requested when searching the user entry.
+func UserAttributes(config *Config) []string {
+	attributes := []string{"dn", "cn", config.Attribute}
+
+	if config.GroupMembership == "memberOf" {
+		attributes = append(attributes, config.MemberOfAttribute)
+	}
+
+	if config.PrimaryGroupResolution {
+		attributes = append(attributes, "primaryGroupID", "objectSid", "gidNumber")
+	}
+
+	if config.ClientCertAuth && config.ClientCertMatchEntry {
+		attributes = append(attributes, "userCertificate;binary", "userCertificate")
+	}
+
+	if config.ADAccountCheck {
+		attributes = append(attributes, "userAccountControl", "accountExpires")
+	}
+
+	for _, ah := range config.ForwardAttributes {
+		attribute, _ := SplitAttributeDecoder(ah.Attribute)
+		attributes = append(attributes, attribute)
+	}
+
+	if config.ForwardJwt {
+		for _, name := range config.JwtAttributes {
+			attribute, _ := SplitAttributeDecoder(name)
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	return attributes
+}
+
+// FilterData the values of filter templates: the Config fields, and the values of the request
+// being authenticated. Those are never stored in Config, which is shared by concurrent requests.
+type FilterData struct {
+	*Config
+	Username       string
+	ApiKeyHash     string
+	CertSubject    string
+	CertCommonName string
+	CertEmail      string
+	CertUPN        string
+}
+
+// ParseSearchFilter remove spaces and trailing from searchFilter.
+func ParseSearchFilter(config *Config, username string) (string, error) {
+	return ParseFilter(config.SearchFilter, FilterData{Config: config, Username: username})
+}
+
+// ParseFilter remove spaces and trailing from filter, then replace data placeholders.
+func ParseFilter(filter string, data FilterData) (string, error) {
+	filter = strings.Trim(filter, "\n\t")
+	filter = strings.TrimSpace(filter)
+	filter = strings.Replace(filter, "\\", "", -1)
+
+	tmpl, err := template.New("search_template").Funcs(filterFuncs).Parse(filter)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+
+	err = tmpl.Execute(&out, data)
+
+	if err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// SetLogger define global logger based in logLevel conf. Instances use their own Logger, so
+// these are only used by functions called with a Config not created by New.
+func SetLogger(level string) {
+	enabled := NewLogger("", level, "text").level
+
+	for i, logger := range []*log.Logger{LoggerDEBUG, LoggerINFO, LoggerWARNING, LoggerERROR} {
+		switch {
+		case i < enabled:
+			logger.SetOutput(ioutil.Discard)
+		case i >= logWarning:
+			logger.SetOutput(os.Stderr)
+		default:
+			logger.SetOutput(os.Stdout)
+		}
+	}
+}
+
+func parseTlsVersion(version string) uint16 {
+	if v, ok := tlsVersions[version]; ok {
+		return v
+	}
+	return tls.VersionTLS10
+}
+
+// tlsVersions the accepted names of each TLS version.
+var tlsVersions = map[string]uint16{
+	"tls.VersionTLS10": tls.VersionTLS10,
+	"VersionTLS10":     tls.VersionTLS10,
+	"tls.VersionTLS11": tls.VersionTLS11,
+	"VersionTLS11":     tls.VersionTLS11,
+	"tls.VersionTLS12": tls.VersionTLS12,
+	"VersionTLS12":     tls.VersionTLS12,
+	"tls.VersionTLS13": tls.VersionTLS13,
+	"VersionTLS13":     tls.VersionTLS13,
+}
+
+// logConfigParams print confs when logLevel is DEBUG.
+func logConfigParams(logger *Logger, v interface{}) {
+	val := reflect.ValueOf(v)
+	printFieldsRecursive(logger, val, "")
+}
+
+// logConfigParams recursively print parameters value.
+func printFieldsRecursive(logger *Logger, val reflect.Value, indent string) {
+	val = reflect.Indirect(val)
+	if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Type().Field(i)
+			fieldValue := val.Field(i)
+
+			if fieldValue.Kind() == reflect.Struct {
+				logger.Debugf("%s%s:\n", indent, field.Name)
+				printFieldsRecursive(logger, fieldValue, indent+"  ")
+			} else if fieldValue.Kind() == reflect.Slice {
+				logger.Debugf("%s%s:\n", indent, field.Name)
+				for j := 0; j < fieldValue.Len(); j++ {
+					printFieldsRecursive(logger, fieldValue.Index(j), indent+"  ")
+				}
+				if fieldValue.Len() == 0 {
+					logger.Debugf("%s'[]'\n", indent+"  ")
+				}
+			} else {
+				logger.Debugf("%s%s: '%v'\n", indent, field.Name, fieldValue)
+			}
+		}
+	} else {
+		logger.Debugf("%s'%v'\n", indent, val.Interface())
+	}
+}
+
+// settingDefaults to serverList parameters no explicit passed by the user
+func settingDefaults(config *Config) {
+	// Rank LDAP servers based on weight. Higher weight, higher precedence
+	sort.Slice(config.ServerList, func(i, j int) bool {
+		return config.ServerList[i].Weight > config.ServerList[j].Weight
+	})
+
+	for i, server := range config.ServerList {
+		// Default MinVersionTLS value
+		if server.MinVersionTLS == "" {
+			config.ServerList[i].MinVersionTLS = "tls.VersionTLS12"
+		}
+
+		// Default MaxVersionTLS value
+		if server.MaxVersionTLS == "" {
+			config.ServerList[i].MaxVersionTLS = "tls.VersionTLS13"
+		}
+
+		// Default Port value
+		if server.Port == 0 {
+			config.ServerList[i].Port = 389
+		}
+	}
+
+	for i, ah := range config.ForwardAttributes {
+		if ah.Separator == "" {
+			config.ForwardAttributes[i].Separator = ","
+		}
+
+		if ah.Encoding == "" {
+			config.ForwardAttributes[i].Encoding = "raw"
+		}
+
+		// Keep the session cookie and the request headers within usual server limits
+		if ah.MaxLength == 0 {
+			config.ForwardAttributes[i].MaxLength = 1024
+		}
+	}
+}
+
+// newRealmConfig build a realm Config, inheriting not explicit passed parameters from config
+func newRealmConfig(config *Config, realm LdapRealmConfig) *Config {
+	rc := *config
+	rc.Realm = realm.Name
+	rc.Realms = nil
+	rc.ServerList = append([]LdapServerConfig{}, realm.ServerList...)
+
+	if realm.Attribute != "" {
+		rc.Attribute = realm.Attribute
+	}
+	if realm.SearchFilter != "" {
+		rc.SearchFilter = realm.SearchFilter
+	}
+	if realm.BaseDN != "" {
+		rc.BaseDN = realm.BaseDN
+	}
+	if realm.BindDN != "" {
+		rc.BindDN = realm.BindDN
+		rc.BindPassword = realm.BindPassword
+	}
+	if realm.EnableNestedGroupFilter {
+		rc.EnableNestedGroupFilter = true
+	}
+	if realm.AllowedGroups != nil {
+		rc.AllowedGroups = realm.AllowedGroups
+	}
+	if realm.AllowedUsers != nil {
+		rc.AllowedUsers = realm.AllowedUsers
+	}
+	if !realm.Requirements.isEmpty() {
+		rc.Requirements = realm.Requirements
+	}
+	if realm.GroupMembership != "" {
+		rc.GroupMembership = realm.GroupMembership
+	}
+	if realm.MemberOfAttribute != "" {
+		rc.MemberOfAttribute = realm.MemberOfAttribute
+	}
+	if realm.NestedGroupResolution {
+		rc.NestedGroupResolution = true
+	}
+	if realm.GroupBaseDN != "" {
+		rc.GroupBaseDN = realm.GroupBaseDN
+	}
+
+	settingDefaults(&rc)
+
+	return &rc
+}
+
+// SplitUsernameDomain split 'user@domain' or 'DOMAIN\user' usernames, returning user and domain.
+func SplitUsernameDomain(username string) (string, string) {
+	if i := strings.LastIndex(username, "@"); i > 0 {
+		return username[:i], username[i+1:]
+	}
+	if i := strings.Index(username, "\\"); i > 0 {
+		return username[i+1:], username[:i]
+	}
+	return username, ""
+}
+
+// selectRealms return the realms to try for username, with the rule authorization requirements.
+// A realm matching the username domain is used alone with the domain stripped, otherwise all
+// realms are tried in order.
+func (la *LdapAuth) selectRealms(username string, rule *AuthorizationRule) ([]*Config, string) {
+	if len(la.config.Realms) == 0 {
+		return RuleConfigs(la.realms, rule), username
+	}
+
+	user, domain := SplitUsernameDomain(username)
+	if domain != "" {
+		for i, realm := range la.config.Realms {
+			for _, d := range realm.Domains {
+				if strings.EqualFold(d, domain) {
+					la.logger.Debugf("Domain '%s' matches realm '%s'", domain, la.realms[i].Realm)
+					return RuleConfigs(la.realms[i:i+1], rule), user
+				}
+			}
+		}
+	}
+
+	return RuleConfigs(la.realms, rule), username
+}
+
+// LocalUser a break-glass user loaded from LocalUsersFile.
+type LocalUser struct {
+	Username     string
+	PasswordHash string
+	Groups       []string
+}
+
+// LoadLocalUsers read a local users file. Each line has the format
+// 'username:{SSHA512}hash:group1;group2', empty lines and lines starting with '#' are ignored.
+func LoadLocalUsers(path string) (map[string]LocalUser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening local users file: %w", err)
+	}
+	defer file.Close()
+
+	users := map[string]LocalUser{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("local users file '%s' line %d: expected 'username:hash[:groups]'", path, n)
+		}
+
+		user := LocalUser{
+			Username:     strings.ToLower(fields[0]),
+			PasswordHash: fields[1],
+		}
+		if _, _, _, err := parsePasswordHash(user.PasswordHash); err != nil {
+			return nil, fmt.Errorf("local users file '%s' line %d: %w", path, n, err)
+		}
+		if len(fields) == 3 && fields[2] != "" {
+			for _, g := range strings.Split(fields[2], ";") {
+				user.Groups = append(user.Groups, strings.TrimSpace(g))
+			}
+		}
+
+		users[user.Username] = user
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading local users file: %w", err)
+	}
+
+	return users, nil
+}
+
+// parsePasswordHash split a '{SSHA}', '{SSHA256}' or '{SSHA512}' hash in hash function, digest and salt.
+func parsePasswordHash(passwordHash string) (func([]byte) []byte, []byte, []byte, error) {
+	var sum func([]byte) []byte
+	var size int
+
+	end := strings.Index(passwordHash, "}")
+	if !strings.HasPrefix(passwordHash, "{") || end < 0 {
+		return nil, nil, nil, errors.New("password hash must start with '{SSHA}', '{SSHA256}' or '{SSHA512}'")
+	}
+
+	switch strings.ToUpper(passwordHash[1:end]) {
+	case "SSHA":
+		sum, size = func(b []byte) []byte { h := sha1.Sum(b); return h[:] }, sha1.Size
+	case "SSHA256":
+		sum, size = func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }, sha256.Size
+	case "SSHA512":
+		sum, size = func(b []byte) []byte { h := sha512.Sum512(b); return h[:] }, sha512.Size
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported password hash scheme '%s'", passwordHash[:end+1])
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(passwordHash[end+1:])
+	if err != nil || len(decoded) <= size {
+		return nil, nil, nil, errors.New("password hash must contain a base64 encoded digest and salt")
+	}
+
+	return sum, decoded[:size], decoded[size:], nil
+}
+
+// CheckPasswordHash check password against a salted '{SSHA}', '{SSHA256}' or '{SSHA512}' hash.
+func CheckPasswordHash(passwordHash, password string) bool {
+	sum, digest, salt, err := parsePasswordHash(passwordHash)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(digest, sum(append([]byte(password), salt...))) == 1
+}
+
+// LocalCheckUser check user and password against local users, then apply the authorization
+// requirements using the groups assigned to the user in the local users file. The group that
+// granted access is returned, if a single one did.
+func LocalCheckUser(users map[string]LocalUser, config *Config, username, password string) (string, error) {
+	user, ok := users[username]
+	if !ok || !CheckPasswordHash(user.PasswordHash, password) {
+		return "", fmt.Errorf("invalid local user credentials for '%s'", username)
+	}
+
+	isMember := func(group string) (bool, error) {
+		for _, ug := range user.Groups {
+			if strings.EqualFold(group, ug) {
+				config.logger.Debugf("Local user: '%s' found in Group: '%s'", username, group)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	_, group, err := CheckRequirements(config, ldap.NewEntry("", nil), username, isMember)
+	if err != nil {
+		return "", fmt.Errorf("Local user: %w", err)
+	}
+
+	return group, nil
+}
+
+// GetApiKey return the API key sent in ApiKeyHeader or in an 'Authorization: ApiKey xxxx' header.
+func GetApiKey(req *http.Request, config *Config) string {
+	if config.ApiKeyAttribute == "" {
+		return ""
+	}
+
+	if key := req.Header.Get(config.ApiKeyHeader); key != "" {
+		return strings.TrimSpace(key)
+	}
+
+	const prefix = "ApiKey "
+	auth := req.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+
+	return ""
+}
+
+// HashApiKey hash an API key as it is stored in ApiKeyAttribute, using ApiKeyHashFormat.
+func HashApiKey(apiKey, format string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	if format == "ldap" {
+		return "{SHA256}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// LdapCheckApiKey search the entry holding the API key hash, then check if it is authorized.
+func LdapCheckApiKey(config *Config, apiKey string) (*ldap.Entry, string, string, error) {
+	conn, serverInUse, err := ConnectServerList(config)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	defer conn.Close()
+
+	data := FilterData{Config: config, ApiKeyHash: ldap.EscapeFilter(HashApiKey(apiKey, config.ApiKeyHashFormat))}
+
+	result, err := SearchModeFilter(conn, data, config.ApiKeySearchFilter)
+	if err != nil {
+		return nil, serverInUse.URL, "", fmt.Errorf("API key lookup failed: %w", err)
+	}
+
+	entry := result.Entries[0]
+	username := strings.ToLower(entry.GetAttributeValue(config.Attribute))
+	if username == "" {
+		username = strings.ToLower(entry.DN)
+	}
+	config.logger.Infof("API key belongs to: %s", entry.DN)
+
+	isAuthorized, err := LdapCheckUserAuthorized(conn, config, entry, username)
+	if !isAuthorized {
+		return entry, serverInUse.URL, username, err
+	}
+
+	if config.ForwardGroups {
+		AddUserGroups(conn, config, entry, username)
+	}
+
+	return entry, serverInUse.URL, username, nil
+}
+
+// serveApiKey authenticate the request using an API key, without saving the session.
+func (la *LdapAuth) serveApiKey(rw http.ResponseWriter, req *http.Request, session *sessions.Session, apiKey string, rule *AuthorizationRule) {
+	realm, entry, server, username, err := lookupRealms(RuleConfigs(la.realms, rule), func(rc *Config) (*ldap.Entry, string, string, error) {
+		return LdapCheckApiKey(rc, apiKey)
+	})
+	la.recordAuth(req, "apikey", rule, username, server, entry, err)
+	if err != nil {
+		RequireAuth(rw, req, la.config, username, err)
+		return
+	}
+
+	la.logger.Infof("API key authentication succeeded")
+
+	session.Values["username"] = username
+	session.Values["realm"] = realm.Realm
+	session.Values["auth-method"] = "apikey"
+	session.Values["ldap-dn"] = entry.DN
+	session.Values["ldap-cn"] = entry.GetAttributeValue("cn")
+	session.Values["ldap-server"] = server
+	SetSessionAttributes(la.config, session, entry)
+	SetSessionGroups(la.config, session, entry.GetAttributeValues(userGroupsAttribute))
+	session.Values["authenticated"] = true
+	session.Values["validated-at"] = time.Now().Unix()
+	session.Values["created-at"] = time.Now().Unix()
+
+	ServeAuthenicated(la, session, rw, req, rule, entry.GetAttributeValue(grantedGroupAttribute))
+}
+
+// lookupRealms run check against each realm in order until one of them finds an authorized entry,
+// returning it with the URL of its server. If an entry is found but not authorized, the other
+// realms are not tried and it is returned along with the error.
+func lookupRealms(realms []*Config, check func(*Config) (*ldap.Entry, string, string, error)) (*Config, *ldap.Entry, string, string, error) {
+	errStrings := []string{}
+	var lastErr error
+	var lastEntry *ldap.Entry
+	var lastServer string
+
+	for _, rc := range realms {
+		entry, server, username, err := check(rc)
+		if err == nil {
+			return rc, entry, server, username, nil
+		}
+
+		rc.logger.Errorf("%s", err)
+		if len(realms) > 1 {
+			err = fmt.Errorf("Realm '%s': %w", rc.Realm, err)
+		}
+		errStrings = append(errStrings, err.Error())
+		lastErr = err
+		lastEntry = entry
+		lastServer = server
+
+		if entry != nil {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		return nil, nil, "", "", ErrEmptySearchResult
+	}
+
+	// Keep the last error wrapped, so its failure reason is still known.
+	previous := strings.Join(errStrings[:len(errStrings)-1], "\n")
+	if previous != "" {
+		previous += "\n"
+	}
+	return nil, lastEntry, lastServer, "", fmt.Errorf("%s%w", previous, lastErr)
+}
+
+// oidUPN is the Microsoft User Principal Name otherName in the subject alternative name.
+var oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+// GetClientCertificate return the verified client certificate of the TLS connection or, when
+// Traefik terminates TLS and ClientCertTrustHeader is set, the one forwarded by the
+// passTLSClientCert middleware in ClientCertHeader, verified against ClientCertCA.
+func GetClientCertificate(req *http.Request, config *Config) (*x509.Certificate, error) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0], nil
+	}
+
+	header := req.Header.Get(config.ClientCertHeader)
+	if header == "" || !config.ClientCertTrustHeader {
+		return nil, nil
+	}
+
+	// passTLSClientCert sends the URL escaped PEMs without delimiters, the client first, then its chain.
+	header, err := url.QueryUnescape(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate header: %w", err)
+	}
+
+	certs := []*x509.Certificate{}
+	for _, value := range strings.Split(header, ",") {
+		var der []byte
+		if block, _ := pem.Decode([]byte(value)); block != nil {
+			der = block.Bytes
+		} else if der, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("invalid client certificate header: %w", err)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	// Anyone can send the header, so it is only as trusted as the CA that issued the certificate.
+	if config.clientCertPool == nil {
+		return nil, errors.New("no clientCertCa to verify the client certificate header")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         config.clientCertPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted client certificate: %w", err)
+	}
+
+	return certs[0], nil
+}
+
+// CertificateUPN return the User Principal Name in the certificate subject alternative name.
+func CertificateUPN(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			continue
+		}
+
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return ""
+		}
+
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return ""
+			}
+
+			// otherName [0] { type-id OBJECT IDENTIFIER, value [0] EXPLICIT ANY }
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+
+			var oid asn1.ObjectIdentifier
+			value, err := asn1.Unmarshal(name.Bytes, &oid)
+			if err != nil || !oid.Equal(oidUPN) {
+				continue
+			}
+
+			var explicit asn1.RawValue
+			if _, err := asn1.Unmarshal(value, &explicit); err != nil {
+				continue
+			}
+
+			var upn string
+			if _, err := asn1.UnmarshalWithParams(explicit.Bytes, &upn, "utf8"); err == nil {
+				return upn
+			}
+		}
+	}
+
+	return ""
+}
+
+// LdapCheckClientCert search the entry mapped from the certificate, then check if it is authorized.
+func LdapCheckClientCert(config *Config, cert *x509.Certificate) (*ldap.Entry, string, string, error) {
+	conn, serverInUse, err := ConnectServerList(config)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	defer conn.Close()
+
+	data := FilterData{
+		Config:         config,
+		CertSubject:    ldap.EscapeFilter(cert.Subject.String()),
+		CertCommonName: ldap.EscapeFilter(cert.Subject.CommonName),
+		CertUPN:        ldap.EscapeFilter(CertificateUPN(cert)),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		data.CertEmail = ldap.EscapeFilter(cert.EmailAddresses[0])
+	}
+
+	result, err := SearchModeFilter(conn, data, config.ClientCertSearchFilter)
+	if err != nil {
+		return nil, serverInUse.URL, "", fmt.Errorf("client certificate lookup failed: %w", err)
+	}
+
+	entry := result.Entries[0]
+	config.logger.Infof("Client certificate '%s' mapped to: %s", cert.Subject, entry.DN)
+
+	if config.ClientCertMatchEntry {
+		found := false
+		for _, attr := range []string{"userCertificate;binary", "userCertificate"} {
+			for _, c := range entry.GetRawAttributeValues(attr) {
+				if bytes.Equal(c, cert.Raw) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, serverInUse.URL, "", fmt.Errorf("client certificate does not match userCertificate of '%s'", entry.DN)
+		}
+	}
+
+	username := strings.ToLower(entry.GetAttributeValue(config.Attribute))
+	if username == "" {
+		username = strings.ToLower(entry.DN)
+	}
+
+	isAuthorized, err := LdapCheckUserAuthorized(conn, config, entry, username)
+	if !isAuthorized {
+		return entry, serverInUse.URL, username, err
+	}
+
+	if config.ForwardGroups {
+		AddUserGroups(conn, config, entry, username)
+	}
+
+	return entry, serverInUse.URL, username, nil
+}
+
+// serveClientCert authenticate the request using the client certificate.
+func (la *LdapAuth) serveClientCert(rw http.ResponseWriter, req *http.Request, session *sessions.Session, cert *x509.Certificate, rule *AuthorizationRule) {
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+
+	if auth, ok := session.Values["authenticated"].(bool); ok && auth && session.Values["cert-fingerprint"] == fingerprint && SessionRuleAllowed(session, rule) {
+		if err := la.checkSession(rw, req, session, rule); err != nil {
+			username, _ := session.Values["username"].(string)
+			la.logger.Warningf("Session of user '%s' revoked: %s", username, err)
+			if errors.Is(err, ErrSessionRevoked) {
+				server, _ := session.Values["ldap-server"].(string)
+				la.recordAuth(req, "certificate", rule, username, server, nil, err)
+				RequireAuth(rw, req, la.config, username, err)
+				return
+			}
+		} else {
+			la.logger.Debugf("Session token Valid! Passing request...")
+			la.config.metrics.inc(MetricCacheRequests, "cache", "session", "result", "hit")
+			ServeAuthenicated(la, session, rw, req, rule, sessionGrantedGroup(session, rule))
+			return
+		}
+	}
+	la.config.metrics.inc(MetricCacheRequests, "cache", "session", "result", "miss")
+
+	realm, entry, server, username, err := lookupRealms(RuleConfigs(la.realms, rule), func(rc *Config) (*ldap.Entry, string, string, error) {
+		return LdapCheckClientCert(rc, cert)
+	})
+	la.recordAuth(req, "certificate", rule, username, server, entry, err)
+	if err != nil {
+		RequireAuth(rw, req, la.config, username, err)
+		return
+	}
+
+	la.logger.Infof("Client certificate authentication succeeded")
+
+	session.Values["username"] = username
+	session.Values["realm"] = realm.Realm
+	session.Values["auth-method"] = "certificate"
+	session.Values["cert-fingerprint"] = fingerprint
+	session.Values["ldap-dn"] = entry.DN
+	session.Values["ldap-cn"] = entry.GetAttributeValue("cn")
+	session.Values["ldap-server"] = server
+	SetSessionAttributes(la.config, session, entry)
+	SetSessionGroups(la.config, session, entry.GetAttributeValues(userGroupsAttribute))
+	session.Values["authenticated"] = true
+	session.Values["validated-at"] = time.Now().Unix()
+	session.Values["created-at"] = time.Now().Unix()
+	group := entry.GetAttributeValue(grantedGroupAttribute)
+	sessionGrant(session, rule, group)
+	la.saveSession(rw, req, session)
+
+	ServeAuthenicated(la, session, rw, req, rule, group)
+}
+
+const passwordChangeForm = `<!DOCTYPE html>
+<html><head><title>Change password</title></head><body>
+<form method="post">
+<p><label>Username <input name="username" autocomplete="username"></label></p>
+<p><label>Current password <input name="password" type="password" autocomplete="current-password"></label></p>
+<p><label>New password <input name="newPassword" type="password" autocomplete="new-password"></label></p>
+<p><label>Confirm new password <input name="confirmPassword" type="password" autocomplete="new-password"></label></p>
+<p><input type="submit" value="Change password"></p>
+</form>
+</body></html>
+`
+
+// servePasswordChange show the password change form on GET and change the user password on POST.
+func (la *LdapAuth) servePasswordChange(rw http.ResponseWriter, req *http.Request, session *sessions.Session) {
+	if req.Method == http.MethodGet {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte(passwordChangeForm))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+
+	// Another site could make the browser of a user post the form, so cross-origin posts are refused.
+	if !SameOrigin(req) {
+		err := errors.New("cross-origin requests are not allowed")
+		la.logger.Warningf("Refusing cross-origin password change from '%s' to '%s'", req.Header.Get("Origin"), req.Host)
+		la.recordAuth(req, "password_change", nil, "", "", nil, err)
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = rw.Write([]byte(fmt.Sprintf("%d %s\nError: %s\n", http.StatusForbidden, http.StatusText(http.StatusForbidden), err)))
+		return
+	}
+
+	// Only form fields are read, never credentials the browser sends on its own.
+	username := strings.ToLower(req.PostFormValue("username"))
+	password := req.PostFormValue("password")
+	newPassword := req.PostFormValue("newPassword")
+
+	var err error
+	var server string
+	switch {
+	case username == "" || password == "" || newPassword == "":
+		err = errors.New("username, current password and new password are required")
+	case req.PostFormValue("confirmPassword") != "" && req.PostFormValue("confirmPassword") != newPassword:
+		err = errors.New("new password and confirmation do not match")
+	}
+
+	realms, realmUsername := la.selectRealms(username, nil)
+	realmKey := RealmNames(realms)
+	if err == nil {
+		if err = la.negativeCacheGet(realmKey, username, password); err != nil {
+			la.logger.Debugf("Failed credentials of user '%s' found in cache", username)
+		}
+	}
+
+	if err == nil {
+		failures := []error{}
+		errStrings := []string{}
+		for _, rc := range realms {
+			server, err = LdapChangePassword(rc, realmUsername, password, newPassword)
+			if err == nil {
+				break
+			}
+			failures = append(failures, err)
+			errStrings = append(errStrings, err.Error())
+			if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) && !errors.Is(err, ErrEmptySearchResult) {
+				break
+			}
+		}
+		if err != nil {
+			la.negativeCacheAdd(realmKey, username, password, failures, strings.Join(errStrings, "\n"))
+		}
+	}
+
+	la.recordAuth(req, "password_change", nil, username, server, nil, err)
+
+	if err != nil {
+		la.logger.Errorf("Password change failed for user '%s': %s", username, err)
+		rw.WriteHeader(http.StatusBadRequest)
+		_, _ = rw.Write([]byte(fmt.Sprintf("%d %s\nError: %s\n", http.StatusBadRequest, http.StatusText(http.StatusBadRequest), PasswordChangeError(err))))
+		return
+	}
+
+	la.logger.Infof("Password changed for user '%s'", username)
+	if la.audit != nil {
+		record := NewAuditRecord(la.name, req, nil, "allowed")
+		record.Username = username
+		record.AuthMethod = "password_change"
+		record.Server = server
+		la.audit.Record(record)
+	}
+
+	// Old credentials are no longer valid, so any session must authenticate again.
+	if session.Values["username"] == username {
+		la.invalidateSession(rw, req, session)
+	}
+
+	_, _ = rw.Write([]byte("Password changed\n"))
+}
+
+// LdapChangePassword bind as the user with the current password and change it to newPassword,
+// using the Password Modify extended operation or, for Active Directory, a unicodePwd modify.
+// The URL of the server used is returned.
+func LdapChangePassword(config *Config, username, password, newPassword string) (string, error) {
+	conn, serverInUse, err := ConnectServerList(config)
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close()
+
+	userDN := BindModeUserDN(config, username)
+	if config.SearchFilter != "" {
+		result, err := SearchMode(conn, config, username)
+		if err != nil {
+			return serverInUse.URL, err
+		}
+		userDN = result.Entries[0].DN
+	}
+
+	config.logger.Debugf("Changing password of User: %s", userDN)
+
+	if err = conn.Bind(userDN, password); err != nil {
+		return serverInUse.URL, err
+	}
+
+	if config.PasswordChangeMode == "activeDirectory" {
+		modify := ldap.NewModifyRequest(userDN, nil)
+		modify.Delete("unicodePwd", []string{encodeUnicodePwd(password)})
+		modify.Add("unicodePwd", []string{encodeUnicodePwd(newPassword)})
+		return serverInUse.URL, conn.Modify(modify)
+	}
+
+	_, err = conn.PasswordModify(ldap.NewPasswordModifyRequest("", password, newPassword))
+	return serverInUse.URL, err
+}
+
+// SameOrigin report if req was not sent by a browser from another site. Sec-Fetch-Site is used
+// when sent, otherwise the Origin header, if any, must match the request host. Requests of
+// non-browser clients send neither, and are allowed.
+func SameOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// encodeUnicodePwd encode password as the quoted UTF-16LE string expected by unicodePwd.
+func encodeUnicodePwd(password string) string {
+	encoded := utf16.Encode([]rune("\"" + password + "\""))
+	b := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		b[2*i] = byte(c)
+		b[2*i+1] = byte(c >> 8)
+	}
+	return string(b)
+}
+
+// PasswordChangeError translate directory errors of a password change into a readable message.
+func PasswordChangeError(err error) string {
+	// Unknown users and wrong passwords get the same message, so users can't be probed.
+	if reason := FailureReason(err); reason == ReasonInvalidCredentials || reason == ReasonUnknownUser {
+		return "the username or current password is incorrect"
+	}
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) {
+		return err.Error()
+	}
+
+	switch ldapErr.ResultCode {
+	case ldap.LDAPResultConstraintViolation:
+		return "the new password does not satisfy the password policy (length, complexity, history or minimum age)"
+	case ldap.LDAPResultInsufficientAccessRights:
+		return "you are not allowed to change your password"
+	case ldap.LDAPResultConfidentialityRequired:
+		return "the directory requires a secure (TLS) connection to change passwords"
+	case ldap.LDAPResultUnwillingToPerform:
+		return "the directory refused to change the password, a secure connection may be required"
+	case ldap.LDAPResultNoSuchObject:
+		return "the username or current password is incorrect"
+	default:
+		return err.Error()
+	}
+}
+
+// adDataCode match the sub-code in Active Directory bind error diagnostic messages.
+var adDataCode = regexp.MustCompile(`data ([0-9a-fA-F]{3,4})`)
+
+// adBindErrors map Active Directory bind error sub-codes to failure reasons and messages.
+var adBindErrors = map[string]AuthError{
+	"525": {Reason: ReasonInvalidCredentials, Message: "Invalid username or password."},
+	"52e": {Reason: ReasonInvalidCredentials, Message: "Invalid username or password."},
+	"530": {Reason: ReasonLogonHours, Message: "You are not allowed to log in at this time."},
+	"531": {Reason: ReasonLogonWorkstation, Message: "You are not allowed to log in from this workstation."},
+	"532": {Reason: ReasonPasswordExpired, Message: "Your password has expired."},
+	"533": {Reason: ReasonAccountDisabled, Message: "Your account is disabled. Please contact your administrator."},
+	"701": {Reason: ReasonAccountExpired, Message: "Your account has expired. Please contact your administrator."},
+	"773": {Reason: ReasonMustChangePassword, Message: "Your password must be changed before logging in."},
+	"775": {Reason: ReasonAccountLocked, Message: "Your account is locked. Please contact your administrator."},
+}
+
+// ADBindError turn an Active Directory invalid credentials error into an AuthError using the
+// 'data xxx' sub-code of its diagnostic message. Other errors are returned unchanged.
+func ADBindError(config *Config, err error) error {
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return err
+	}
+
+	match := adDataCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	authErr, ok := adBindErrors[strings.ToLower(match[1])]
+	if !ok {
+		return err
+	}
+
+	config.logger.Debugf("Active Directory bind error data %s: %s", match[1], authErr.Reason)
+
+	if config.PasswordChangePath != "" && (authErr.Reason == ReasonPasswordExpired || authErr.Reason == ReasonMustChangePassword) {
+		authErr.Message += fmt.Sprintf(" Please change it at '%s'.", config.PasswordChangePath)
+	}
+	authErr.Err = err
+
+	return &authErr
+}
+
+// Active Directory userAccountControl flags.
+const (
+	adAccountDisable      = 0x0002
+	adLockout             = 0x0010
+	adPasswordExpired     = 0x800000
+	adAccountNeverExpires = 0x7FFFFFFFFFFFFFFF
+)
+
+// ADAccountState check the userAccountControl and accountExpires attributes of an Active
+// Directory entry, returning an AuthError if the account can't be used at now.
+func ADAccountState(entry *ldap.Entry, now time.Time) error {
+	uac, _ := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+
+	switch {
+	case uac&adAccountDisable != 0:
+		return &AuthError{Reason: ReasonAccountDisabled, Message: adBindErrors["533"].Message}
+	case uac&adLockout != 0:
+		return &AuthError{Reason: ReasonAccountLocked, Message: adBindErrors["775"].Message}
+	case uac&adPasswordExpired != 0:
+		return &AuthError{Reason: ReasonPasswordExpired, Message: adBindErrors["532"].Message}
+	}
+
+	// accountExpires is a FILETIME, 100-nanosecond intervals since 1601-01-01 UTC.
+	expires, _ := strconv.ParseInt(entry.GetAttributeValue("accountExpires"), 10, 64)
+	if expires > 0 && expires != adAccountNeverExpires {
+		const epochDiff = 116444736000000000 // FILETIME of 1970-01-01
+		if expires < now.UnixNano()/100+epochDiff {
+			return &AuthError{Reason: ReasonAccountExpired, Message: adBindErrors["701"].Message}
+		}
+	}
+
+	return nil
+}
+
+// defaultRuleName identify requests not matching any rule in the session.
+const defaultRuleName = "default"
+
+// CompileRules name the unnamed rules, check them and compile their PathRegex, once before
+// serving requests.
+func CompileRules(rules []AuthorizationRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i)
+		}
+		// Without allow requirements any user would be authorized, so it must be explicit.
+		requirements := rule.Requirements
+		if !rule.AllowAnyUser && len(rule.AllowedUsers) == 0 && len(rule.AllowedGroups) == 0 && len(requirements.AllOfGroups) == 0 && len(requirements.AnyOfGroups) == 0 {
+			return fmt.Errorf("rule '%s' allows no users nor groups, set allowAnyUser to allow any authenticated user", rule.Name)
+		}
+		if rule.PathRegex != "" {
+			var err error
+			if rule.pathRegexp, err = regexp.Compile(rule.PathRegex); err != nil {
+				return fmt.Errorf("rule '%s' has an invalid pathRegex: %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MatchRule return the first rule matching the request host, path and method, or nil. Rules
+// must be compiled by CompileRules, a PathRegex not compiled never matches.
+func MatchRule(rules []AuthorizationRule, req *http.Request) *AuthorizationRule {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	urlPath := CleanPath(req.URL.Path)
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if len(rule.Hosts) > 0 && !matchHost(rule.Hosts, host) {
+			continue
+		}
+		if rule.PathPrefix != "" && !strings.HasPrefix(urlPath, rule.PathPrefix) {
+			continue
+		}
+		if rule.PathRegex != "" && (rule.pathRegexp == nil || !rule.pathRegexp.MatchString(urlPath)) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !matchMethod(rule.Methods, req.Method) {
+			continue
+		}
+
+		return rule
+	}
+
+	return nil
+}
+
+// CleanPath return the canonical form of a request path, keeping its trailing slash, so paths
+// like '//admin' or '/x/../admin' are matched as '/admin'.
+func CleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// matchHost check host against a list of hosts, where '*.example.com' matches any subdomain.
+func matchHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && len(host) > len(h)-1 && strings.EqualFold(host[len(host)-len(h)+1:], h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMethod check method against a list of HTTP methods.
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleName return the rule name, or 'default' when no rule matches.
+func RuleName(rule *AuthorizationRule) string {
+	if rule == nil {
+		return defaultRuleName
+	}
+	return rule.Name
+}
+
+// RuleConfig return a copy of config with the rule authorization requirements. The deny
+// requirements of config are kept, so they still take precedence.
+func RuleConfig(config *Config, rule *AuthorizationRule) *Config {
+	if rule == nil {
+		return config
+	}
+
+	rc := *config
+	rc.AllowedUsers = rule.AllowedUsers
+	rc.AllowedGroups = rule.AllowedGroups
+	rc.Requirements = rule.Requirements
+	rc.Requirements.DenyGroups = append(append([]string{}, config.Requirements.DenyGroups...), rule.Requirements.DenyGroups...)
+	rc.Requirements.DenyUsers = append(append([]string{}, config.Requirements.DenyUsers...), rule.Requirements.DenyUsers...)
+	if rule.AllowAnyUser {
+		rc.AllowedUsers = nil
+		rc.AllowedGroups = nil
+		rc.Requirements.AllOfGroups = nil
+		rc.Requirements.AnyOfGroups = nil
+	}
+
+	return &rc
+}
+
+// RuleConfigs return RuleConfig for each of configs.
+func RuleConfigs(configs []*Config, rule *AuthorizationRule) []*Config {
+	if rule == nil {
+		return configs
+	}
+
+	rcs := make([]*Config, 0, len(configs))
+	for _, config := range configs {
+		rcs = append(rcs, RuleConfig(config, rule))
+	}
+
+	return rcs
+}
+
+// SessionRuleAllowed check if the session was already authorized for rule.
+func SessionRuleAllowed(session *sessions.Session, rule *AuthorizationRule) bool {
+	rules, _ := session.Values["rules"].(string)
+	return strings.Contains(rules, "|"+RuleName(rule)+"|")
+}
+
+// SessionAddRule record in the session that user was authorized for rule.
+func SessionAddRule(session *sessions.Session, rule *AuthorizationRule) {
+	rules, _ := session.Values["rules"].(string)
+	if rules == "" {
+		rules = "|"
+	}
+	if !strings.Contains(rules, "|"+RuleName(rule)+"|") {
+		rules += RuleName(rule) + "|"
+	}
+	session.Values["rules"] = rules
+}
+
+// sessionGrant record in the session that user was authorized for rule, by group if a single one
+// granted it.
+func sessionGrant(session *sessions.Session, rule *AuthorizationRule, group string) {
+	SessionAddRule(session, rule)
+	session.Values["granted-rule"] = RuleName(rule)
+	session.Values["granted-group"] = group
+}
+
+// sessionGrantedGroup return the group that granted rule to the session user, if it was the last
+// rule the user was authorized for.
+func sessionGrantedGroup(session *sessions.Session, rule *AuthorizationRule) string {
+	if session.Values["granted-rule"] != RuleName(rule) {
+		return ""
+	}
+	group, _ := session.Values["granted-group"].(string)
+	return group
+}
+
+// resolvedGroup the DNs of a group name or filter, and when they were resolved.
+type resolvedGroup struct {
+	dns        []string
+	resolvedAt time.Time
+}
+
+// groupResolver cache the DNs of the group names and filters used in a realm.
+type groupResolver struct {
+	mu     sync.Mutex
+	groups map[string]resolvedGroup
+}
+
+// IsGroupDN check if a group is given by its DN, instead of by a name or a filter.
+func IsGroupDN(group string) bool {
+	if strings.HasPrefix(group, "(") || !strings.Contains(group, "=") {
+		return false
+	}
+	_, err := ldap.ParseDN(group)
+	return err == nil
+}
+
+// GroupSpecs return the groups used by config and rules that are given by a name or a filter.
+func GroupSpecs(config *Config, rules []AuthorizationRule) []string {
+	groups := [][]string{
+		config.AllowedGroups,
+		config.Requirements.AllOfGroups,
+		config.Requirements.AnyOfGroups,
+		config.Requirements.DenyGroups,
+	}
+	for _, rule := range rules {
+		groups = append(groups,
+			rule.AllowedGroups,
+			rule.Requirements.AllOfGroups,
+			rule.Requirements.AnyOfGroups,
+			rule.Requirements.DenyGroups,
+		)
+	}
+
+	specs := []string{}
+	for _, list := range groups {
+		for _, g := range list {
+			if !IsGroupDN(g) {
+				specs = append(specs, g)
+			}
+		}
+	}
+
+	return specs
+}
+
+// RefreshGroupNames resolve groups now, then every GroupRefreshInterval seconds until ctx is done.
+func RefreshGroupNames(ctx context.Context, config *Config, groups []string) {
+	if len(groups) == 0 {
+		return
+	}
+
+	ResolveGroupNames(config, groups)
+	if config.GroupRefreshInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(config.GroupRefreshInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ResolveGroupNames(config, groups)
+		}
+	}
+}
+
+// ResolveGroupNames connect to the config servers and resolve groups, so requests don't have to.
+// Cached groups are searched again.
+func ResolveGroupNames(config *Config, groups []string) {
+	if len(groups) == 0 {
+		return
+	}
+
+	conn, _, err := ConnectServerList(config)
+	if err != nil {
+		config.logger.Warningf("Unable to resolve group names: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if config.BindDN != "" && config.BindPassword != "" {
+		err = conn.Bind(config.BindDN, config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		config.logger.Warningf("Unable to resolve group names: BindDN Error: %s", err)
+		return
+	}
+
+	for _, g := range groups {
+		if _, err := LdapSearchGroupName(conn, config, g); err != nil {
+			config.logger.Warningf("Unable to resolve group '%s': %s", g, err)
+		}
+	}
+}
+
+// LdapResolveGroupName return the DNs of a group name, searched in GroupNameAttribute, or of the
+// groups matching a filter. Results are cached for GroupRefreshInterval seconds.
+func LdapResolveGroupName(conn *ldap.Conn, config *Config, group string) ([]string, error) {
+	r := config.groupResolver
+	if r != nil {
+		r.mu.Lock()
+		cached, ok := r.groups[group]
+		r.mu.Unlock()
+		if ok && time.Since(cached.resolvedAt) < time.Duration(config.GroupRefreshInterval)*time.Second {
+			return cached.dns, nil
+		}
+	}
+
+	return LdapSearchGroupName(conn, config, group)
+}
+
+// LdapSearchGroupName search the DNs of a group name or filter, and cache them.
+func LdapSearchGroupName(conn *ldap.Conn, config *Config, group string) ([]string, error) {
+	filter := group
+	if !strings.HasPrefix(group, "(") {
+		filter = fmt.Sprintf("(%s=%s)", config.GroupNameAttribute, ldap.EscapeFilter(group))
+	}
+
+	dns, err := LdapSearchGroups(conn, config, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	config.logger.Debugf("Group '%s' resolved to: %v", group, dns)
+
+	if r := config.groupResolver; r != nil {
+		r.mu.Lock()
+		r.groups[group] = resolvedGroup{dns: dns, resolvedAt: time.Now()}
+		r.mu.Unlock()
+	}
+
+	return dns, nil
+}
+
+// withGroupNames wrap isMember, resolving groups given by a name or a filter to their DNs. The
+// user is a member of such a group if it's a member of any of the resolved DNs.
+func withGroupNames(conn *ldap.Conn, config *Config, isMember func(group string) (bool, error)) func(group string) (bool, error) {
+	return func(group string) (bool, error) {
+		if IsGroupDN(group) {
+			return isMember(group)
+		}
+
+		dns, err := LdapResolveGroupName(conn, config, group)
+		if err != nil {
+			return false, err
+		}
+
+		for _, dn := range dns {
+			if member, err := isMember(dn); member || err != nil {
+				return member, err
+			}
+		}
+
+		return false, nil
+	}
+}
+
+// SetSessionAttributes store the header values of config ForwardAttributes from entry in session.
+func SetSessionAttributes(config *Config, session *sessions.Session, entry *ldap.Entry) {
+	for _, ah := range config.ForwardAttributes {
+		values, err := EntryAttributeValues(entry, ah.Attribute)
+		if err != nil {
+			config.logger.Warningf("Unable to forward attribute '%s' of User: '%s': %s", ah.Attribute, entry.DN, err)
+			continue
+		}
+		session.Values["ldap-attr-"+ah.Attribute] = EncodeHeaderValue(strings.Join(values, ah.Separator), ah.Encoding, ah.MaxLength)
+	}
+
+	if config.ForwardJwt {
+		for _, attr := range config.JwtAttributes {
+			values, err := EntryAttributeValues(entry, attr)
+			if err != nil {
+				config.logger.Warningf("Unable to forward attribute '%s' of User: '%s': %s", attr, entry.DN, err)
+				continue
+			}
+			session.Values["jwt-attr-"+attr] = values
+		}
+	}
+}
+
+// attributeDecoders decode binary attribute values, like objectGUID and objectSid, to strings.
+var attributeDecoders = map[string]func([]byte) (string, error){
+	"guid": DecodeGUID,
+	"sid":  DecodeSID,
+	"base64": func(value []byte) (string, error) {
+		return base64.StdEncoding.EncodeToString(value), nil
+	},
+	"hex": func(value []byte) (string, error) {
+		return hex.EncodeToString(value), nil
+	},
+}
+
+// SplitAttributeDecoder split an 'attribute:decoder' name, like 'objectGUID:guid'. The decoder is
+// empty when name is just an attribute.
+func SplitAttributeDecoder(name string) (string, string) {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// EntryAttributeValues return the values of the attribute of entry named by name, decoded if name
+// has a decoder.
+func EntryAttributeValues(entry *ldap.Entry, name string) ([]string, error) {
+	attribute, decoder := SplitAttributeDecoder(name)
+	if decoder == "" {
+		return entry.GetAttributeValues(attribute), nil
+	}
+
+	decode := attributeDecoders[decoder]
+	if decode == nil {
+		return nil, fmt.Errorf("unknown decoder '%s'", decoder)
+	}
+
+	values := []string{}
+	for _, raw := range entry.GetRawAttributeValues(attribute) {
+		value, err := decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// DecodeGUID return the canonical string of a binary GUID, whose first three fields are little
+// endian, as Active Directory objectGUID.
+func DecodeGUID(guid []byte) (string, error) {
+	if len(guid) != 16 {
+		return "", fmt.Errorf("invalid GUID of %d bytes", len(guid))
+	}
+
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10],
+		guid[10:16],
+	), nil
+}
+
+// EncodeGUID return the binary form of a canonical GUID string, the reverse of DecodeGUID.
+func EncodeGUID(guid string) ([]byte, error) {
+	parts := strings.Split(guid, "-")
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if len(parts) != 5 || err != nil || len(raw) != 16 {
+		return nil, fmt.Errorf("invalid GUID '%s'", guid)
+	}
+
+	binary.LittleEndian.PutUint32(raw[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(raw[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(raw[6:8], binary.BigEndian.Uint16(raw[6:8]))
+
+	return raw, nil
+}
+
+// EncodeSID return the binary form of a 'S-1-5-21-...' SID string, the reverse of DecodeSID.
+func EncodeSID(sid string) ([]byte, error) {
+	parts := strings.Split(sid, "-")
+	if len(parts) < 3 || len(parts) > 3+15 || !strings.EqualFold(parts[0], "S") {
+		return nil, fmt.Errorf("invalid SID '%s'", sid)
+	}
+
+	revision, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SID '%s': %w", sid, err)
+	}
+	authority, err := strconv.ParseUint(parts[2], 10, 48)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SID '%s': %w", sid, err)
+	}
+
+	raw := make([]byte, 8, 8+4*(len(parts)-3))
+	raw[0] = byte(revision)
+	raw[1] = byte(len(parts) - 3)
+	for i := 7; i >= 2; i-- {
+		raw[i] = byte(authority)
+		authority >>= 8
+	}
+
+	for _, part := range parts[3:] {
+		subAuthority, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SID '%s': %w", sid, err)
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(subAuthority))
+		raw = append(raw, b[:]...)
+	}
+
+	return raw, nil
+}
+
+// filterFuncs the functions available in filter templates, escaping binary values so they can
+// be matched, like '(objectGUID={{guid .Username}})'.
+var filterFuncs = template.FuncMap{
+	"guid": func(guid string) (string, error) {
+		raw, err := EncodeGUID(guid)
+		return EscapeFilterBytes(raw), err
+	},
+	"sid": func(sid string) (string, error) {
+		raw, err := EncodeSID(sid)
+		return EscapeFilterBytes(raw), err
+	},
+}
+
+// EncodeHeaderValue encode value as a header value, truncating it so the encoded value is no
+// longer than maxLength bytes. Truncation happens before encoding, on a character boundary.
+func EncodeHeaderValue(value, encoding string, maxLength int) string {
+	for {
+		var encoded string
+		switch encoding {
+		case "base64":
+			encoded = base64.StdEncoding.EncodeToString([]byte(value))
+		case "rfc2047":
+			encoded = mime.BEncoding.Encode("UTF-8", value)
+		default:
+			// Control characters, like newlines, are not allowed in a header value.
+			encoded = strings.Map(func(r rune) rune {
+				if r < ' ' && r != '\t' || r == 0x7f {
+					return -1
+				}
+				return r
+			}, value)
+		}
+
+		if maxLength <= 0 || len(encoded) <= maxLength {
+			return encoded
+		}
+
+		// Encodings don't shrink values, so at least the excess must be cut.
+		n := len(value) - ((len(encoded)-maxLength)*3+3)/4
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(value[n]) {
+			n--
+		}
+		value = value[:n]
+	}
+}
+
+// userGroupsAttribute the entry attribute holding the groups found by AddUserGroups.
+const userGroupsAttribute = "ldapAuth-groups"
+
+// LdapUserGroups return the DNs of the groups the user belongs to, using the same membership
+// strategy as the group checks.
+func LdapUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) ([]string, error) {
+	if config.NestedGroupResolution {
+		return LdapResolveUserGroups(conn, config, entry, username)
+	}
+
+	var groups []string
+	if config.GroupMembership == "memberOf" {
+		groups = entry.GetAttributeValues(config.MemberOfAttribute)
+	} else {
+		filter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+			ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(username))
+		if config.EnableNestedGroupFilter {
+			filter = fmt.Sprintf("(|%s(member:1.2.840.113556.1.4.1941:=%s))", filter, ldap.EscapeFilter(entry.DN))
+		}
+
+		var err error
+		if groups, err = LdapSearchGroups(conn, config, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PrimaryGroupResolution {
+		primaryGroups, err := LdapPrimaryGroups(conn, config, entry)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, primaryGroups...)
+	}
+
+	return groups, nil
+}
+
+// AddUserGroups add the user groups to entry, so they can be forwarded. Failing to find them
+// doesn't fail the authentication, the user is forwarded without groups.
+func AddUserGroups(conn *ldap.Conn, config *Config, entry *ldap.Entry, username string) {
+	groups, err := LdapUserGroups(conn, config, entry, username)
+	if err != nil {
+		config.logger.Warningf("Unable to find groups of User: '%s': %s", entry.DN, err)
+		return
+	}
+
+	entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(userGroupsAttribute, groups))
+}
+
+// SetSessionGroups store the user groups in session, filtered by ForwardGroupsFilter and
+// shortened to their CN if ForwardGroupsCN is set.
+func SetSessionGroups(config *Config, session *sessions.Session, userGroups []string) {
+	if !config.ForwardGroups {
+		return
+	}
+
+	groups := []string{}
+	for _, g := range userGroups {
+		if config.forwardGroupsRegexp != nil && !config.forwardGroupsRegexp.MatchString(g) {
+			continue
+		}
+		if config.ForwardGroupsCN {
+			g = GroupCN(g)
+		}
+		groups = append(groups, g)
+	}
+
+	session.Values["groups"] = groups
+}
+
+// GroupCN return the value of the first RDN of dn if it's a CN, or dn otherwise.
+func GroupCN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+
+	return dn
+}
+
+// FormatGroups return groups as a ForwardGroupsSeparator delimited list, or as a JSON array.
+func FormatGroups(config *Config, groups []string) string {
+	if config.ForwardGroupsFormat == "json" {
+		if groups == nil {
+			groups = []string{}
+		}
+		value, _ := json.Marshal(groups)
+		return string(value)
+	}
+
+	return strings.Join(groups, config.ForwardGroupsSeparator)
+}
+
+// jwtHashes the hash of each JWT algorithm size.
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// jwtCurves the curve of each ECDSA JWT algorithm.
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// LoadJwtKey return the JwtAlgorithm signing key, read from JwtKeyFile or JwtKey: the secret
+// itself for HMAC, a PEM encoded private key for RSA and ECDSA.
+func LoadJwtKey(config *Config) (interface{}, error) {
+	alg := config.JwtAlgorithm
+	if len(alg) != 5 || jwtHashes[alg[2:]] == 0 {
+		return nil, fmt.Errorf("invalid jwtAlgorithm '%s'", alg)
+	}
+
+	key := []byte(config.JwtKey)
+	if config.JwtKeyFile != "" {
+		var err error
+		if key, err = ioutil.ReadFile(config.JwtKeyFile); err != nil {
+			return nil, fmt.Errorf("Error reading JWT key file: %w", err)
+		}
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("forwardJwt needs a jwtKey or a jwtKeyFile")
+	}
+
+	if alg[:2] == "HS" {
+		return key, nil
+	}
+
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, fmt.Errorf("JWT key is not PEM encoded")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT key: %w", err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if alg[:2] == "RS" {
+			return k, nil
+		}
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().Name == jwtCurves[alg] {
+			return k, nil
+		}
+	}
+
+	return nil, fmt.Errorf("JWT key does not match jwtAlgorithm '%s'", alg)
+}
+
+// JwtClaims return the claims asserting the identity stored in session.
+func JwtClaims(config *Config, session *sessions.Session, now time.Time) map[string]interface{} {
+	method, _ := session.Values["auth-method"].(string)
+	claims := map[string]interface{}{
+		"sub": session.Values["username"],
+		"dn":  session.Values["ldap-dn"],
+		// RFC 8176 defines amr as an array of methods.
+		"amr": []string{method},
+		"iat": now.Unix(),
+		"exp": now.Add(time.Duration(config.JwtExpiration) * time.Second).Unix(),
+	}
+
+	if config.JwtIssuer != "" {
+		claims["iss"] = config.JwtIssuer
+	}
+	if config.JwtAudience != "" {
+		claims["aud"] = config.JwtAudience
+	}
+	if realm, ok := session.Values["realm"].(string); ok && realm != "" {
+		claims["realm"] = realm
+	}
+	if groups, ok := session.Values["groups"].([]string); ok {
+		claims["groups"] = groups
+	}
+
+	for _, name := range config.JwtAttributes {
+		values, _ := session.Values["jwt-attr-"+name].([]string)
+		attr, _ := SplitAttributeDecoder(name)
+		switch len(values) {
+		case 0:
+		case 1:
+			claims[attr] = values[0]
+		default:
+			claims[attr] = values
+		}
+	}
+
+	return claims
+}
+
+// SignJwt return claims as a compact JWT signed with key using JwtAlgorithm.
+func SignJwt(config *Config, key interface{}, claims map[string]interface{}) (string, error) {
+	header := map[string]string{"alg": config.JwtAlgorithm, "typ": "JWT"}
+	if config.JwtKeyID != "" {
+		header["kid"] = config.JwtKeyID
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hash := jwtHashes[config.JwtAlgorithm[2:]]
+	var signature []byte
+
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signingInput))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil)); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed size big-endian R and S, instead of ASN.1.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	default:
+		return "", fmt.Errorf("unsupported JWT key")
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// checkSession check that a cached session is still valid, then re-issue its cookie only when it
+// was revalidated or half of CacheIdleTimeout elapsed since it was issued, sliding the idle timeout
+// without a Set-Cookie on every response. A session failing its revalidation is invalidated and
+// ErrSessionRevoked returned, so the request must be denied.
+func (la *LdapAuth) checkSession(rw http.ResponseWriter, req *http.Request, session *sessions.Session, rule *AuthorizationRule) error {
+	// Re-issued cookies are valid for a new MaxAge, so the expiration is checked from the login.
+	if expiry := la.sessionExpiry(session); !time.Now().Before(expiry) {
+		return fmt.Errorf("session expired at %s", expiry.UTC().Format(time.RFC3339))
+	}
+
+	issuedAt, _ := session.Values["issued-at"].(int64)
+	if la.config.CacheIdleTimeout > 0 && time.Since(time.Unix(issuedAt, 0)) >= time.Duration(la.config.CacheIdleTimeout)*time.Second {
+		return fmt.Errorf("session idle for more than %ds", la.config.CacheIdleTimeout)
+	}
+
+	revalidated, err := la.revalidateSession(session, rule)
+	if err != nil {
+		la.invalidateSession(rw, req, session)
+		return fmt.Errorf("%w: %s", ErrSessionRevoked, err)
+	}
+
+	if revalidated || la.config.CacheIdleTimeout > 0 && time.Since(time.Unix(issuedAt, 0)) >= time.Duration(la.config.CacheIdleTimeout)*time.Second/2 {
+		la.saveSession(rw, req, session)
+	}
+
+	return nil
+}
+
+// sessionExpiry return when session expires whatever its activity: CacheMaxLifetime after the
+// login, or CacheTimeout after it if sooner and CacheIdleTimeout is not set.
+func (la *LdapAuth) sessionExpiry(session *sessions.Session) time.Time {
+	createdAt, _ := session.Values["created-at"].(int64)
+	lifetime := la.config.CacheMaxLifetime
+	if la.config.CacheIdleTimeout == 0 && la.config.CacheTimeout < lifetime {
+		lifetime = la.config.CacheTimeout
+	}
+	return time.Unix(createdAt, 0).Add(time.Duration(lifetime) * time.Second)
+}
+
+// saveSession issue the session cookie, expiring no later than sessionExpiry, so re-issuing it
+// never extends the session.
+func (la *LdapAuth) saveSession(rw http.ResponseWriter, req *http.Request, session *sessions.Session) {
+	now := time.Now()
+	session.Values["issued-at"] = now.Unix()
+
+	remaining := int(la.sessionExpiry(session).Sub(now).Seconds())
+	if remaining <= 0 {
+		// A zero MaxAge would turn it into a browser session cookie.
+		remaining = -1
+	}
+	if remaining < session.Options.MaxAge {
+		session.Options.MaxAge = remaining
+	}
+
+	err := session.Save(req, rw)
+	if err != nil {
+		// Cookies are limited to 4KB, so keep the session without what is only forwarded.
+		la.logger.Errorf("Unable to save session of user '%s', dropping its forwarded groups and attributes: %s", session.Values["username"], err)
+		DropSessionForwards(session)
+		err = session.Save(req, rw)
+	}
+	if err != nil {
+		la.logger.Errorf("Unable to save session of user '%s': %s", session.Values["username"], err)
+	}
+}
+
+// invalidateSession expire the session cookie, so the user must authenticate again.
+func (la *LdapAuth) invalidateSession(rw http.ResponseWriter, req *http.Request, session *sessions.Session) {
+	session.Values["authenticated"] = false
+	session.Options.MaxAge = -1
+	if err := session.Save(req, rw); err != nil {
+		la.logger.Errorf("Unable to invalidate session of user '%s': %s", session.Values["username"], err)
+	}
+}
+
+// DropSessionForwards remove the groups and attributes forwarded to the backend from session.
+func DropSessionForwards(session *sessions.Session) {
+	for key := range session.Values {
+		name, _ := key.(string)
+		if name == "groups" || strings.HasPrefix(name, "ldap-attr-") || strings.HasPrefix(name, "jwt-attr-") {
+			delete(session.Values, key)
+		}
+	}
+}
+
+// revalidateSession check again that the session user exists, is enabled and is authorized, once
+// CacheRevalidateInterval elapsed since the last check. The directory is queried with the service
+// account, so the password is not needed. The returned bool reports if the check was made.
+func (la *LdapAuth) revalidateSession(session *sessions.Session, rule *AuthorizationRule) (bool, error) {
+	if la.config.CacheRevalidateInterval == 0 {
+		return false, nil
+	}
+
+	validatedAt, _ := session.Values["validated-at"].(int64)
+	if time.Since(time.Unix(validatedAt, 0)) < time.Duration(la.config.CacheRevalidateInterval)*time.Second {
+		return false, nil
+	}
+
+	// Local users can't change while the middleware runs.
+	if session.Values["auth-method"] != "local" {
+		username, _ := session.Values["username"].(string)
+		realmName, _ := session.Values["realm"].(string)
+		userDN, _ := session.Values["ldap-dn"].(string)
+
+		realms, realmUsername := la.selectRealms(username, rule)
+		var realm *Config
+		for _, rc := range realms {
+			if rc.Realm == realmName {
+				realm = rc
+			}
+		}
+		if realm == nil {
+			return false, fmt.Errorf("realm '%s' not found", realmName)
+		}
+
+		la.logger.Debugf("Revalidating session of User: '%s'", userDN)
+		if err := LdapRevalidateUser(realm, realmUsername, userDN); err != nil {
+			return false, err
+		}
+	}
+
+	session.Values["validated-at"] = time.Now().Unix()
+
+	return true, nil
+}
+
+// LdapRevalidateUser check, using BindDN, that the entry of userDN still exists, is enabled if
+// ADAccountCheck is set, and is authorized.
+func LdapRevalidateUser(config *Config, username, userDN string) error {
+	conn, _, err := ConnectServerList(config)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if config.BindDN != "" && config.BindPassword != "" {
+		err = conn.Bind(config.BindDN, config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return fmt.Errorf("BindDN Error: %w", err)
+	}
+
+	entry, err := LdapReadEntry(conn, config, userDN)
+	if err != nil {
+		return err
+	}
+
+	if config.ADAccountCheck {
+		if err = ADAccountState(entry, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	isAuthorized, err := LdapCheckUserAuthorized(conn, config, entry, username)
+	if !isAuthorized {
+		if err == nil {
+			err = fmt.Errorf("User '%s' is no longer authorized", userDN)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// negativeCacheGet return the cached failure of username and password in realms, if any.
+func (la *LdapAuth) negativeCacheGet(realms, username, password string) error {
+	if la.negativeCache == nil {
+		return nil
+	}
+
+	for _, key := range []string{CredentialKey(la.hashKey, "unknown", realms, username), CredentialKey(la.hashKey, "invalid", realms, username, password)} {
+		if cached, ok := la.negativeCache.Get(key); ok {
+			la.config.metrics.inc(MetricCacheRequests, "cache", "negative", "result", "hit")
+			return cached.(error)
+		}
+	}
+	la.config.metrics.inc(MetricCacheRequests, "cache", "negative", "result", "miss")
+
+	return nil
+}
+
+// negativeCacheAdd remember failures that retrying can't fix before the directory changes.
+func (la *LdapAuth) negativeCacheAdd(realms, username, password string, failures []error, message string) {
+	if la.negativeCache == nil {
+		return
+	}
+
+	if key, failure := NegativeCacheEntry(la.hashKey, realms, username, password, failures, message); key != "" {
+		la.negativeCache.Add(key, failure)
+	}
+}
+
+// NegativeCacheEntry return the negative cache key and error of failures in realms, or an empty key
+// if they must not be cached. Users not found by the search filter are cached whatever the password, and
+// invalid credentials with the password. Failures of unreachable servers, locked accounts or
+// authorization are never cached.
+func NegativeCacheEntry(key []byte, realms, username, password string, failures []error, message string) (string, error) {
+	unknown := true
+	for _, err := range failures {
+		if errors.Is(err, ErrEmptySearchResult) {
+			continue
+		}
+		if FailureReason(err) != ReasonInvalidCredentials {
+			return "", nil
+		}
+		unknown = false
+	}
+
+	// The failure reason is kept, so cached failures are still counted by reason.
+	if unknown {
+		return CredentialKey(key, "unknown", realms, username), &AuthError{Reason: ReasonUnknownUser, Message: message, Err: ErrEmptySearchResult}
+	}
+	return CredentialKey(key, "invalid", realms, username, password), &AuthError{Reason: ReasonInvalidCredentials, Message: message}
+}
+
+// cachedCredential the result of a successful authentication kept in the credential cache.
+type cachedCredential struct {
+	realm  string
+	server string
+	entry  *ldap.Entry
+}
+
+// RealmNames return the names of realms, identifying the directories a credential is checked against.
+func RealmNames(realms []*Config) string {
+	names := make([]string, 0, len(realms))
+	for _, rc := range realms {
+		names = append(names, rc.Realm)
+	}
+	return strings.Join(names, ",")
+}
+
+// CredentialKey return a keyed hash of parts, so credentials can be looked up without storing
+// plaintext passwords.
+func CredentialKey(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		// Length prefixes keep ("ab", "c") and ("a", "bc") apart.
+		fmt.Fprintf(mac, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TTLCache a size bounded cache whose entries expire after a TTL, evicting the least recently
+// used entry when full. It's safe for concurrent use.
+type TTLCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type ttlCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// NewTTLCache create a TTLCache holding up to size entries for ttl.
+func NewTTLCache(size int, ttl time.Duration) *TTLCache {
+	return &TTLCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Get return the value of key, if it's in the cache and not expired.
+func (c *TTLCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*ttlCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return entry.value, true
+}
+
+// Add set the value of key, expiring after the cache TTL.
+func (c *TTLCache) Add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.expiresAt = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&ttlCacheEntry{key: key, value: value, expiresAt: time.Now().Add(c.ttl)})
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlCacheEntry).key)
+	}
+}
+
+// Remove delete key from the cache.
+func (c *TTLCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// Len return the number of entries in the cache, including expired ones not yet removed.
+func (c *TTLCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// requestStartKey the request context key of the time ServeHTTP started, to log latencies.
+type requestStartKey struct{}
+
+// Fields the structured fields of a log line.
+type Fields map[string]interface{}
+
+const (
+	logDebug = iota
+	logInfo
+	logWarning
+	logError
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+// Logger a leveled logger owned by a middleware instance, writing text or JSON lines. A nil
+// Logger writes to the package LoggerDEBUG, LoggerINFO, LoggerWARNING and LoggerERROR.
+type Logger struct {
+	name   string
+	level  int
+	json   bool
+	fields Fields
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// NewLogger create the Logger of the name instance, writing messages of level and above, using
+// the text or json format. DEBUG and INFO go to stdout, WARNING and ERROR to stderr.
+func NewLogger(name, level, format string) *Logger {
+	l := &Logger{
+		name:   name,
+		level:  logInfo,
+		json:   format == "json",
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+
+	if i, ok := parseLogLevel(level); ok {
+		l.level = i
+	}
+
+	return l
+}
+
+// parseLogLevel return the index in logLevelNames of level, case insensitive.
+func parseLogLevel(level string) (int, bool) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(level, n) {
+			return i, true
+		}
+	}
+	return logInfo, false
+}
+
+// SetOutput write every level to w, instead of stdout and stderr.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.stdout = w
+	l.stderr = w
+}
+
+// With return a Logger adding fields to every line.
+func (l *Logger) With(fields Fields) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	child := *l
+	child.fields = merged
+	return &child
+}
 
-	LoggerDEBUG.Printf("Group Filter: '%s'", group_filter.String())
+// Debugf log a DEBUG message.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(logDebug, format, v...)
+}
 
-	res, err := conn.WhoAmI(nil)
-	if err != nil {
-		LoggerERROR.Printf("Failed to call WhoAmI(): %s", err)
-	} else {
-		LoggerDEBUG.Printf("Using credential: '%s' for Search Groups", res.AuthzID)
+// Infof log an INFO message.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(logInfo, format, v...)
+}
+
+// Warningf log a WARNING message.
+func (l *Logger) Warningf(format string, v ...interface{}) {
+	l.output(logWarning, format, v...)
+}
+
+// Errorf log an ERROR message.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(logError, format, v...)
+}
+
+// output write the message if level is enabled. It must be called directly by the level methods,
+// so the caller is found at a fixed depth.
+func (l *Logger) output(level int, format string, v ...interface{}) {
+	if l == nil {
+		legacy := []*log.Logger{LoggerDEBUG, LoggerINFO, LoggerWARNING, LoggerERROR}[level]
+		_ = legacy.Output(3, fmt.Sprintf(format, v...))
+		return
 	}
 
-	for _, g := range config.AllowedGroups {
+	if level < l.level {
+		return
+	}
 
-		LoggerDEBUG.Printf("Searching Group: '%s' with User: '%s'", g, entry.DN)
-
-		search := ldap.NewSearchRequest(
-			g,
-			ldap.ScopeBaseObject,
-			ldap.NeverDerefAliases,
-			0,
-			0,
-			false,
-			group_filter.String(),
-			[]string{"member", "uniqueMember", "memberUid"},
-			nil,
-		)
+	msg := fmt.Sprintf(format, v...)
 
-		var result *ldap.SearchResult
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", file[strings.LastIndex(file, "/")+1:], line)
+	}
 
-		result, err = conn.Search(search)
+	now := time.Now()
+	var line []byte
 
-		if err != nil {
-			LoggerINFO.Printf("%s", err)
+	if l.json {
+		entry := map[string]interface{}{}
+		for k, v := range l.fields {
+			entry[k] = v
 		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = strings.ToLower(logLevelNames[level])
+		entry["plugin"] = "ldapAuth"
+		entry["instance"] = l.name
+		entry["caller"] = caller
+		entry["msg"] = msg
 
-		// Found one group that user belongs, break loop.
-		if len(result.Entries) > 0 {
-			LoggerDEBUG.Printf("User: '%s' found in Group: '%s'", entry.DN, g)
-			found = true
-			break
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			line, _ = json.Marshal(map[string]string{"level": "error", "msg": fmt.Sprintf("Unable to encode log line: %s", err)})
 		}
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s: ldapAuth: %s %s: [%s] %s", logLevelNames[level], now.Format("2006/01/02 15:04:05"), caller, l.name, msg)
 
-		LoggerDEBUG.Printf("User: '%s' not found in Group: '%s'", username, g)
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%q", k, fmt.Sprint(l.fields[k]))
+		}
+		line = []byte(b.String())
 	}
 
-	return found, err
+	out := l.stdout
+	if level >= logWarning {
+		out = l.stderr
+	}
+	_, _ = out.Write(append(line, '\n'))
 }
 
-// RequireAuth set Auth request.
-func RequireAuth(w http.ResponseWriter, req *http.Request, config *Config, err error) {
-	LoggerDEBUG.Println(err)
-	w.Header().Set("Content-Type", "text/plain")
-	if config.WWWAuthenticateHeader {
-		wwwHeaderContent := "Basic"
-		if config.WWWAuthenticateHeaderRealm != "" {
-			wwwHeaderContent = fmt.Sprintf("Basic realm=\"%s\"", config.WWWAuthenticateHeaderRealm)
-		}
-		w.Header().Set("WWW-Authenticate", wwwHeaderContent)
+// requestLogger return logger with the request ID, read from LogRequestIDHeader, and the latency
+// since ServeHTTP started.
+func requestLogger(logger *Logger, req *http.Request, config *Config) *Logger {
+	fields := Fields{}
+
+	if id := req.Header.Get(config.LogRequestIDHeader); config.LogRequestIDHeader != "" && id != "" {
+		fields["request_id"] = id
+	}
+	if start, ok := req.Context().Value(requestStartKey{}).(time.Time); ok {
+		fields["latency_ms"] = float64(time.Since(start).Microseconds()) / 1000
 	}
 
-	w.WriteHeader(http.StatusUnauthorized)
+	return logger.With(fields)
+}
 
-	errMsg := strings.Trim(err.Error(), "\x00")
-	_, _ = w.Write([]byte(fmt.Sprintf("%d %s\nError: %s\n", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized), errMsg)))
+// Metric names reported to the MetricsCollector.
+const (
+	MetricAuthAttempts        = "ldapauth_auth_attempts_total"
+	MetricCacheRequests       = "ldapauth_cache_requests_total"
+	MetricLdapDuration        = "ldapauth_ldap_operation_duration_seconds"
+	MetricLdapFailovers       = "ldapauth_ldap_failovers_total"
+	MetricAuthorizationDenial = "ldapauth_authorization_denials_total"
+)
+
+var metricsHelp = map[string]string{
+	MetricAuthAttempts:        "Authentication attempts by method, outcome and reason.",
+	MetricCacheRequests:       "Session, credential and negative cache lookups by result.",
+	MetricLdapDuration:        "Latency of LDAP connect, bind and search operations by server.",
+	MetricLdapFailovers:       "Failed connections to a server of ServerList, before trying the next one.",
+	MetricAuthorizationDenial: "Authorization denials by rule and group.",
 }
 
-// Connect return a LDAP Connection.
-func Connect(config LdapServerConfig) (*ldap.Conn, error) {
-	var conn *ldap.Conn = nil
-	var certPool *x509.CertPool
-	var err error = nil
+// MetricsBuckets the upper bounds, in seconds, of the histogram buckets of Metrics.
+var MetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
-	if config.CertificateAuthority != "" {
-		certPool = x509.NewCertPool()
-		certPool.AppendCertsFromPEM([]byte(config.CertificateAuthority))
+// MetricsCollector receive the counters and histograms of the middleware. Metrics is the built-in
+// collector served on MetricsPath, another one can be injected with SetMetricsCollector.
+type MetricsCollector interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveHistogram(name string, value float64, labels map[string]string)
+}
+
+var injectedCollector MetricsCollector
+
+// SetMetricsCollector report the metrics of middleware instances created afterwards to collector,
+// instead of their built-in Metrics.
+func SetMetricsCollector(collector MetricsCollector) {
+	injectedCollector = collector
+}
+
+// instanceMetrics report the metrics of a middleware instance, labelled with its name. A nil
+// instanceMetrics discards them.
+type instanceMetrics struct {
+	collector MetricsCollector
+	instance  string
+}
+
+func (im *instanceMetrics) labels(pairs []string) map[string]string {
+	labels := map[string]string{"instance": im.instance}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels[pairs[i]] = pairs[i+1]
 	}
+	return labels
+}
 
-	u, err := url.Parse(config.URL)
-	if err != nil {
-		return nil, err
+func (im *instanceMetrics) inc(name string, pairs ...string) {
+	if im == nil {
+		return
 	}
+	im.collector.IncCounter(name, im.labels(pairs))
+}
 
-	host, _, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		// we assume that error is due to missing port.
-		host = u.Host
+// ldapOperation observe the latency of an LDAP operation on server started at start.
+func (im *instanceMetrics) ldapOperation(server, operation string, start time.Time) {
+	if im == nil {
+		return
 	}
+	im.collector.ObserveHistogram(MetricLdapDuration, time.Since(start).Seconds(), im.labels([]string{"server", server, "operation", operation}))
+}
 
-	address := u.Scheme + "://" + net.JoinHostPort(host, strconv.FormatUint(uint64(config.Port), 10))
-	LoggerDEBUG.Printf("Connect Address: '%s'", address)
+// recordAuth count an authentication attempt of method and, when it failed, audit the denial by
+// server. Allowed requests are audited by ServeAuthenicated, including those of cached sessions.
+func (la *LdapAuth) recordAuth(req *http.Request, method string, rule *AuthorizationRule, username, server string, entry *ldap.Entry, err error) {
+	if err == nil {
+		la.config.metrics.inc(MetricAuthAttempts, "method", method, "outcome", "success", "reason", "")
+		return
+	}
 
-	tlsCfg := &tls.Config{
-		InsecureSkipVerify: config.InsecureSkipVerify,
-		ServerName:         host,
-		RootCAs:            certPool,
-		MinVersion:         parseTlsVersion(config.MinVersionTLS),
-		MaxVersion:         parseTlsVersion(config.MaxVersionTLS),
+	la.config.metrics.inc(MetricAuthAttempts, "method", method, "outcome", "failure", "reason", FailureReason(err))
+
+	var authzErr *AuthorizationError
+	if errors.As(err, &authzErr) {
+		la.config.metrics.inc(MetricAuthorizationDenial, "rule", RuleName(rule), "group", authzErr.Group)
 	}
 
-	if u.Scheme == "ldap" && config.StartTLS {
-		conn, err = ldap.DialURL(address)
-		if err == nil {
-			err = conn.StartTLS(tlsCfg)
-		}
-	} else if u.Scheme == "ldaps" {
-		conn, err = ldap.DialURL(address, ldap.DialWithTLSConfig(tlsCfg))
-	} else {
-		conn, err = ldap.DialURL(address)
+	la.auditDenial(req, method, rule, username, server, entry, err)
+}
+
+// auditDenial audit a request denied by err.
+func (la *LdapAuth) auditDenial(req *http.Request, method string, rule *AuthorizationRule, username, server string, entry *ldap.Entry, err error) {
+	if la.audit == nil {
+		return
 	}
 
-	if err != nil {
-		return nil, err
+	record := NewAuditRecord(la.name, req, rule, "denied")
+	record.Username = username
+	record.AuthMethod = method
+	record.Reason = FailureReason(err)
+	record.Server = server
+	if entry != nil {
+		record.DN = entry.DN
+	}
+	var authzErr *AuthorizationError
+	if errors.As(err, &authzErr) {
+		record.Group = authzErr.Group
 	}
+	la.audit.Record(record)
+}
 
-	return conn, nil
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
 }
 
-// SearchMode make search to LDAP and return results.
-func SearchMode(conn *ldap.Conn, config *Config) (*ldap.SearchResult, error) {
-	if config.BindDN != "" && config.BindPassword != "" {
-		LoggerDEBUG.Printf("Performing User BindDN Search")
-		err := conn.Bind(config.BindDN, config.BindPassword)
-		if err != nil {
-			return nil, fmt.Errorf("BindDN Error: %w", err)
-		}
-	} else {
-		LoggerDEBUG.Printf("Performing AnonymousBind Search")
-		_ = conn.UnauthenticatedBind("")
+// Metrics a MetricsCollector keeping metrics in memory, written in the Prometheus text format.
+type Metrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// NewMetrics return an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
 	}
+}
 
-	parsedSearchFilter, err := ParseSearchFilter(config)
-	LoggerDEBUG.Printf("Search Filter: '%s'", parsedSearchFilter)
+// IncCounter add one to the counter name with labels.
+func (m *Metrics) IncCounter(name string, labels map[string]string) {
+	key := metricLabels(labels)
 
-	if err != nil {
-		return nil, err
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]float64{}
 	}
+	m.counters[name][key]++
+}
 
-	search := ldap.NewSearchRequest(
-		config.BaseDN,
-		ldap.ScopeWholeSubtree,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		parsedSearchFilter,
-		[]string{"dn", "cn"},
-		nil,
-	)
+// ObserveHistogram add value to the histogram name with labels.
+func (m *Metrics) ObserveHistogram(name string, value float64, labels map[string]string) {
+	key := metricLabels(labels)
 
-	result, err := conn.Search(search)
-	if err != nil {
-		LoggerERROR.Printf("Search Filter Error")
-		return nil, err
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.histograms[name] == nil {
+		m.histograms[name] = map[string]*histogram{}
 	}
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(MetricsBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, bound := range MetricsBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
 
-	switch {
-	case len(result.Entries) == 1:
-		return result, nil
-	case len(result.Entries) < 1:
-		return nil, fmt.Errorf("search filter return empty result")
-	default:
-		return nil, fmt.Errorf(fmt.Sprintf("search filter return multiple entries (%d)", len(result.Entries)))
+// WriteMetrics write all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteMetrics(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(&b, name, "counter")
+		series := m.counters[name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", name, metricBraces(key), formatMetricValue(series[key]))
+		}
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricHeader(&b, name, "histogram")
+		series := m.histograms[name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := series[key]
+			for i, bound := range MetricsBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, metricBraces(joinMetricLabels(key, "le", formatMetricValue(bound))), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, metricBraces(joinMetricLabels(key, "le", "+Inf")), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, metricBraces(key), formatMetricValue(h.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, metricBraces(key), h.count)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
-// ParseSearchFilter remove spaces and trailing from searchFilter.
-func ParseSearchFilter(config *Config) (string, error) {
-	filter := config.SearchFilter
+// ServeHTTP serve the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WriteMetrics(rw)
+}
 
-	filter = strings.Trim(filter, "\n\t")
-	filter = strings.TrimSpace(filter)
-	filter = strings.Replace(filter, "\\", "", -1)
+func writeMetricHeader(b *strings.Builder, name, kind string) {
+	if help, ok := metricsHelp[name]; ok {
+		help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+		fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+}
 
-	tmpl, err := template.New("search_template").Parse(filter)
-	if err != nil {
-		return "", err
+// metricLabels render labels sorted by name, as written between the braces of a series.
+func metricLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	var out bytes.Buffer
+	key := ""
+	for _, name := range names {
+		key = joinMetricLabels(key, name, labels[name])
+	}
+	return key
+}
 
-	err = tmpl.Execute(&out, config)
+func joinMetricLabels(key, name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	if key != "" {
+		key += ","
+	}
+	return fmt.Sprintf("%s%s=\"%s\"", key, name, value)
+}
 
-	if err != nil {
-		return "", err
+func metricBraces(key string) string {
+	if key == "" {
+		return ""
 	}
+	return "{" + key + "}"
+}
 
-	return out.String(), nil
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
 }
 
-// SetLogger define global logger based in logLevel conf.
-func SetLogger(level string) {
-	switch level {
-	case "ERROR":
-		LoggerERROR.SetOutput(os.Stderr)
-	case "WARNING":
-		LoggerERROR.SetOutput(os.Stderr)
-		LoggerWARNING.SetOutput(os.Stderr)
-	case "INFO":
-		LoggerERROR.SetOutput(os.Stderr)
-		LoggerWARNING.SetOutput(os.Stderr)
-		LoggerINFO.SetOutput(os.Stdout)
-	case "DEBUG":
-		LoggerERROR.SetOutput(os.Stderr)
-		LoggerWARNING.SetOutput(os.Stderr)
-		LoggerINFO.SetOutput(os.Stdout)
-		LoggerDEBUG.SetOutput(os.Stdout)
-	default:
-		LoggerERROR.SetOutput(os.Stderr)
-		LoggerWARNING.SetOutput(os.Stderr)
-		LoggerINFO.SetOutput(os.Stdout)
+// AuditRecord an authentication or authorization decision, written as a JSON line.
+type AuditRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Instance   string    `json:"instance"`
+	ClientIP   string    `json:"client_ip"`
+	Username   string    `json:"username,omitempty"`
+	DN         string    `json:"dn,omitempty"`
+	Realm      string    `json:"realm,omitempty"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Method     string    `json:"method"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason,omitempty"`
+	Rule       string    `json:"rule"`
+	Group      string    `json:"group,omitempty"`
+	Server     string    `json:"server,omitempty"`
+}
+
+// NewAuditRecord return the record of the decision about req, matching rule, made by instance.
+func NewAuditRecord(instance string, req *http.Request, rule *AuthorizationRule, decision string) AuditRecord {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	return AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Instance:  instance,
+		ClientIP:  clientIP,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Method:    req.Method,
+		Decision:  decision,
+		Rule:      RuleName(rule),
 	}
 }
 
-func parseTlsVersion(version string) uint16 {
-	switch version {
-	case "tls.VersionTLS10", "VersionTLS10":
-		return tls.VersionTLS10
-	case "tls.VersionTLS11", "VersionTLS11":
-		return tls.VersionTLS11
-	case "tls.VersionTLS12", "VersionTLS12":
-		return tls.VersionTLS12
-	case "tls.VersionTLS13", "VersionTLS13":
-		return tls.VersionTLS13
-	default:
-		LoggerWARNING.Printf("Version: '%s' doesnt match any value. Using 'tls.VersionTLS10' instead", version)
-		LoggerWARNING.Printf("Please check https://pkg.go.dev/crypto/tls#pkg-constants to a list of valid versions")
-		return tls.VersionTLS10
+// AuditSink a destination of audit records.
+type AuditSink interface {
+	WriteRecord(record AuditRecord) error
+}
+
+// AuditLogger write audit records to its sinks in the background. Records are dropped, and an
+// error logged, when its buffer is full, so auditing never blocks requests. A nil AuditLogger
+// discards records.
+type AuditLogger struct {
+	records chan AuditRecord
+	sinks   []AuditSink
+	logger  *Logger
+}
+
+// NewAuditLogger return an AuditLogger buffering up to size records, logging sink errors to logger.
+// Once ctx is done, the queued records are written and the sinks that are an io.Closer closed.
+func NewAuditLogger(ctx context.Context, logger *Logger, size int, sinks ...AuditSink) *AuditLogger {
+	a := &AuditLogger{
+		records: make(chan AuditRecord, size),
+		sinks:   sinks,
+		logger:  logger,
 	}
+	go a.run(ctx)
+	return a
 }
 
-// logConfigParams print confs when logLevel is DEBUG.
-func logConfigParams(v interface{}) {
-	val := reflect.ValueOf(v)
-	printFieldsRecursive(val, "")
+// Record queue record to be written to the sinks.
+func (a *AuditLogger) Record(record AuditRecord) {
+	if a == nil {
+		return
+	}
+
+	select {
+	case a.records <- record:
+	default:
+		a.logger.Errorf("Audit buffer full, dropping %s record of user '%s'", record.Decision, record.Username)
+	}
 }
 
-// logConfigParams recursively print parameters value.
-func printFieldsRecursive(val reflect.Value, indent string) {
-	val = reflect.Indirect(val)
-	if val.Kind() == reflect.Struct {
-		for i := 0; i < val.NumField(); i++ {
-			field := val.Type().Field(i)
-			fieldValue := val.Field(i)
+func (a *AuditLogger) run(ctx context.Context) {
+	defer a.close()
 
-			if fieldValue.Kind() == reflect.Struct {
-				LoggerDEBUG.Printf("%s%s:\n", indent, field.Name)
-				printFieldsRecursive(fieldValue, indent+"  ")
-			} else if fieldValue.Kind() == reflect.Slice {
-				LoggerDEBUG.Printf("%s%s:\n", indent, field.Name)
-				for j := 0; j < fieldValue.Len(); j++ {
-					printFieldsRecursive(fieldValue.Index(j), indent+"  ")
-				}
-				if fieldValue.Len() == 0 {
-					LoggerDEBUG.Printf("%s'[]'\n", indent+"  ")
+	for {
+		select {
+		case record := <-a.records:
+			a.write(record)
+		case <-ctx.Done():
+			for {
+				select {
+				case record := <-a.records:
+					a.write(record)
+				default:
+					return
 				}
-			} else {
-				LoggerDEBUG.Printf("%s%s: '%v'\n", indent, field.Name, fieldValue)
 			}
 		}
-	} else {
-		LoggerDEBUG.Printf("%s'%v'\n", indent, val.Interface())
 	}
 }
 
-// settingDefaults to serverList parameters no explicit passed by the user
-func settingDefaults(config *Config) {
-	for i, server := range config.ServerList {
-		// Default MinVersionTLS value
-		if server.MinVersionTLS == "" {
-			config.ServerList[i].MinVersionTLS = "tls.VersionTLS12"
+func (a *AuditLogger) write(record AuditRecord) {
+	for _, sink := range a.sinks {
+		if err := sink.WriteRecord(record); err != nil {
+			a.logger.Errorf("Unable to write audit record: %s", err)
 		}
+	}
+}
 
-		// Default MaxVersionTLS value
-		if server.MaxVersionTLS == "" {
-			config.ServerList[i].MaxVersionTLS = "tls.VersionTLS13"
+func (a *AuditLogger) close() {
+	for _, sink := range a.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				a.logger.Errorf("Unable to close audit sink: %s", err)
+			}
 		}
+	}
+}
 
-		// Default Port value
-		if server.Port == 0 {
-			config.ServerList[i].Port = 389
+// FileAuditSink append records as JSON Lines to the file at Path. The file is opened for each
+// record, so it can be rotated by moving it away.
+type FileAuditSink struct {
+	Path string
+}
+
+func (s *FileAuditSink) WriteRecord(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Syslog priority of audit records, in the authpriv facility.
+const (
+	syslogFacilityAuthpriv = 10
+	syslogSeverityNotice   = 5
+	syslogSeverityInfo     = 6
+)
+
+// SyslogAuditSink send records as RFC 5424 messages, over UDP or over TCP with the octet
+// counting framing of RFC 6587. Denied requests are sent with the notice severity.
+type SyslogAuditSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+// NewSyslogAuditSink return a SyslogAuditSink to address, 'udp://host:port' or 'tcp://host:port'.
+// The connection is made on the first record, and made again after write errors.
+func NewSyslogAuditSink(address string) (*SyslogAuditSink, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid auditSyslogAddress '%s', expected 'udp://host:port' or 'tcp://host:port'", address)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogAuditSink{network: u.Scheme, address: u.Host, hostname: hostname}, nil
+}
+
+func (s *SyslogAuditSink) WriteRecord(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	severity := syslogSeverityInfo
+	if record.Decision != "allowed" {
+		severity = syslogSeverityNotice
+	}
+	msg := FormatSyslog(s.hostname, os.Getpid(), record.Timestamp, severity, line)
+	if s.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	if s.conn == nil {
+		if s.conn, err = net.DialTimeout(s.network, s.address, 5*time.Second); err != nil {
+			return err
 		}
 	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err = s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// Close close the connection, if any. A later record connects again.
+func (s *SyslogAuditSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// FormatSyslog return an RFC 5424 message of the ldapAuth app in the authpriv facility, with msg
+// as its UTF-8 content and no structured data.
+func FormatSyslog(hostname string, pid int, timestamp time.Time, severity int, msg []byte) []byte {
+	header := fmt.Sprintf("<%d>1 %s %s ldapAuth %d audit - \xef\xbb\xbf",
+		syslogFacilityAuthpriv*8+severity, timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), hostname, pid)
+	return append([]byte(header), msg...)
 }